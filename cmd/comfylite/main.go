@@ -1,68 +1,307 @@
-package main
-
-import (
-	"context"
-	"log"
-	"net/http"
-	"os"
-
-	"github.com/CP-Payne/comfylite/internal/api"
-	"github.com/CP-Payne/comfylite/internal/comfy"
-	"github.com/CP-Payne/comfylite/internal/notifier"
-	"github.com/CP-Payne/comfylite/internal/service"
-	"github.com/CP-Payne/comfylite/internal/tracker"
-	"github.com/CP-Payne/comfylite/internal/workflow"
-	"github.com/go-chi/chi/v5"
-	"github.com/google/uuid"
-	"github.com/joho/godotenv"
-)
-
-func main() {
-
-	err := godotenv.Load()
-	if err != nil {
-		log.Println("Warning: .env file not found, using default values or environment variables.")
-	}
-
-	comfyLiteAddr := GetEnvOrDefault("COMFYLITE_ADDRESS", ":8083")
-	comfyUIAddr := GetEnvOrDefault("COMFYUI_ADDRESS", "http://127.0.0.1:8000")
-
-	ctx := context.Background()
-	clientID := uuid.New()
-
-	manager := workflow.NewManager("templates", "configs")
-	webhookNotifier := notifier.NewHTTPNotifier()
-
-	comfyClient := comfy.NewClient(comfyUIAddr, clientID.String())
-	eventChan := make(chan tracker.Event, 100)
-
-	tracker := tracker.New(webhookNotifier)
-
-	go tracker.Start(ctx, eventChan)
-
-	if err := comfyClient.Start(ctx, eventChan); err != nil {
-		log.Fatalf("Failed to start ComfyUI client: %v", err)
-	}
-
-	service := service.NewService(manager, comfyClient, tracker)
-	handler := api.NewHandler(service)
-
-	r := chi.NewRouter()
-	r.Post("/generate", handler.HandleGenerateImage)
-
-	log.Printf("Starting ComfyLite server on %s\n", comfyLiteAddr)
-	if err := http.ListenAndServe(comfyLiteAddr, r); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
-	}
-
-}
-
-func GetEnvOrDefault(key string, defaultVal string) string {
-
-	val, exist := os.LookupEnv(key)
-	if !exist {
-		return defaultVal
-	}
-
-	return val
-}
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/CP-Payne/comfylite/internal/api"
+	"github.com/CP-Payne/comfylite/internal/comfy"
+	"github.com/CP-Payne/comfylite/internal/imagestore"
+	"github.com/CP-Payne/comfylite/internal/notifier"
+	"github.com/CP-Payne/comfylite/internal/service"
+	"github.com/CP-Payne/comfylite/internal/store"
+	"github.com/CP-Payne/comfylite/internal/tracker"
+	"github.com/CP-Payne/comfylite/internal/workflow"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/joho/godotenv"
+)
+
+func main() {
+
+	err := godotenv.Load()
+	if err != nil {
+		log.Println("Warning: .env file not found, using default values or environment variables.")
+	}
+
+	comfyLiteAddr := GetEnvOrDefault("COMFYLITE_ADDRESS", ":8083")
+	comfyUIAddr := GetEnvOrDefault("COMFYUI_ADDRESS", "http://127.0.0.1:8000")
+	defaultWorkflow := GetEnvOrDefault("COMFYLITE_DEFAULT_WORKFLOW", "flux")
+	syncTimeout := GetEnvDurationOrDefault("COMFYLITE_SYNC_TIMEOUT", 5*time.Minute)
+	jobRetention := GetEnvDurationOrDefault("COMFYLITE_JOB_RETENTION", 24*time.Hour)
+	jobRetentionCount := GetEnvIntOrDefault("COMFYLITE_JOB_RETENTION_COUNT", 1000)
+
+	ctx := context.Background()
+	clientID := uuid.New()
+
+	manager := workflow.NewManager("templates", "configs")
+	if !manager.Exists(defaultWorkflow) {
+		log.Fatalf("Default workflow %q has no matching template and config", defaultWorkflow)
+	}
+	webhookNotifier, err := notifier.NewHTTPNotifier(notifier.Options{
+		OutboxDir:             GetEnvOrDefault("COMFYLITE_WEBHOOK_OUTBOX_DIR", "data/webhooks"),
+		MaxAttempts:           GetEnvIntOrDefault("COMFYLITE_WEBHOOK_MAX_ATTEMPTS", 8),
+		BaseDelay:             GetEnvDurationOrDefault("COMFYLITE_WEBHOOK_BACKOFF", 2*time.Second),
+		MaxDelay:              GetEnvDurationOrDefault("COMFYLITE_WEBHOOK_MAX_BACKOFF", 10*time.Minute),
+		Secret:                GetEnvOrDefault("COMFYLITE_WEBHOOK_SECRET", ""),
+		AllowPrivateAddresses: GetEnvBoolOrDefault("COMFYLITE_WEBHOOK_ALLOW_PRIVATE", false),
+	})
+	if err != nil {
+		log.Fatalf("Failed to create webhook notifier: %v", err)
+	}
+	if err := webhookNotifier.Start(ctx); err != nil {
+		log.Fatalf("Failed to start webhook notifier: %v", err)
+	}
+
+	imageSigner := imagestore.NewURLSigner(imageURLSecret())
+	imageStore, err := newImageStore(imageSigner, GetEnvOrDefault("COMFYLITE_PUBLIC_URL", publicURL(comfyLiteAddr)))
+	if err != nil {
+		log.Fatalf("Failed to create image store: %v", err)
+	}
+
+	backends := comfyBackends(comfyUIAddr)
+	comfyClient := comfy.NewPool(backends, clientID.String(), GetEnvDurationOrDefault("COMFYUI_HEALTH_INTERVAL", 5*time.Second))
+	eventChan := make(chan tracker.Event, 100)
+
+	jobStore := store.NewMemoryJobStore(jobRetention, jobRetentionCount)
+	if jobDir := GetEnvOrDefault("COMFYLITE_JOB_STORE_DIR", "data/jobs"); jobDir != "" {
+		jobStore, err = store.NewFileJobStore(jobDir, jobRetention, jobRetentionCount)
+		if err != nil {
+			log.Fatalf("Failed to create job store: %v", err)
+		}
+	}
+	tracker := tracker.New(webhookNotifier, jobStore, imageStore)
+
+	go tracker.Start(ctx, eventChan)
+
+	service := service.NewService(manager, comfyClient, tracker, jobStore, imageStore, service.QueueOptions{
+		// Two prompts per backend keep each GPU busy while the next prompt is being loaded
+		MaxInFlight: GetEnvIntOrDefault("COMFYLITE_MAX_IN_FLIGHT", 2*len(backends)),
+		MaxQueued:   GetEnvIntOrDefault("COMFYLITE_MAX_QUEUED", 100),
+
+		MaxQueuedPerTenant: GetEnvIntOrDefault("COMFYLITE_MAX_QUEUED_PER_TENANT", 0),
+		TenantWeights:      tenantWeights(GetEnvPairs("COMFYLITE_TENANT_WEIGHTS")),
+	}, service.InputOptions{
+		AllowImageURLs: GetEnvBoolOrDefault("COMFYLITE_ALLOW_IMAGE_URLS", false),
+	})
+	// Jobs in flight in ComfyUI have to be adopted before the client connects and reconciles them
+	service.Recover()
+
+	if err := comfyClient.Start(ctx, eventChan); err != nil {
+		log.Fatalf("Failed to start ComfyUI client: %v", err)
+	}
+	go service.Start(ctx)
+	handler := api.NewHandler(service, defaultWorkflow, syncTimeout, imageSigner)
+
+	r := chi.NewRouter()
+	r.Group(func(r chi.Router) {
+		r.Use(api.RequireAPIKey(GetEnvPairs("COMFYLITE_API_KEYS")))
+		r.Post("/generate", handler.HandleGenerateImage)
+		r.Post("/workflows/{name}/generate", handler.HandleGenerateImage)
+		r.Get("/workflows", handler.HandleListWorkflows)
+		r.Get("/workflows/{name}", handler.HandleGetWorkflow)
+		r.Get("/jobs/{id}", handler.HandleGetJob)
+		r.Get("/jobs/{id}/events", handler.HandleJobEvents)
+		r.Delete("/jobs/{id}", handler.HandleCancelJob)
+	})
+	// Image links carry their own signature so browsers can load them without an API key
+	r.Get("/images/{id}", handler.HandleGetImage)
+
+	log.Printf("Starting ComfyLite server on %s\n", comfyLiteAddr)
+	if err := http.ListenAndServe(comfyLiteAddr, r); err != nil {
+		log.Fatalf("Failed to start server: %v", err)
+	}
+
+}
+
+// newImageStore builds the store selected by COMFYLITE_IMAGE_STORE. It returns a nil store when
+// none is configured, images are then sent inline as base64. Unless COMFYLITE_IMAGE_URLS is
+// "direct", image URLs point at ComfyLite's /images endpoint below publicURL.
+func newImageStore(signer *imagestore.URLSigner, publicURL string) (imagestore.ImageStore, error) {
+	urlExpiry := GetEnvDurationOrDefault("COMFYLITE_IMAGE_URL_EXPIRY", 24*time.Hour)
+
+	urlMode := GetEnvOrDefault("COMFYLITE_IMAGE_URLS", "signed")
+	baseURL := GetEnvOrDefault("COMFYLITE_IMAGE_BASE_URL", "")
+
+	var images imagestore.ImageStore
+	var err error
+	switch kind := GetEnvOrDefault("COMFYLITE_IMAGE_STORE", ""); kind {
+	case "":
+		return nil, nil
+	case "local":
+		if urlMode == "direct" && baseURL == "" {
+			return nil, fmt.Errorf("COMFYLITE_IMAGE_BASE_URL is required for direct URLs to the local image store")
+		}
+		images, err = imagestore.NewLocalStore(GetEnvOrDefault("COMFYLITE_IMAGE_DIR", "data/images"), baseURL)
+	case "s3":
+		images, err = imagestore.NewS3Store(imagestore.S3Options{
+			Endpoint:      GetEnvOrDefault("COMFYLITE_S3_ENDPOINT", ""),
+			Region:        GetEnvOrDefault("COMFYLITE_S3_REGION", "us-east-1"),
+			Bucket:        GetEnvOrDefault("COMFYLITE_S3_BUCKET", ""),
+			AccessKey:     GetEnvOrDefault("COMFYLITE_S3_ACCESS_KEY", ""),
+			SecretKey:     GetEnvOrDefault("COMFYLITE_S3_SECRET_KEY", ""),
+			PathStyle:     GetEnvBoolOrDefault("COMFYLITE_S3_PATH_STYLE", false),
+			PublicBaseURL: GetEnvOrDefault("COMFYLITE_S3_PUBLIC_URL", ""),
+			URLExpiry:     urlExpiry,
+		})
+	default:
+		return nil, fmt.Errorf("unknown image store %q, expected local or s3", kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch urlMode {
+	case "signed":
+		return imagestore.WithSignedURLs(images, signer, publicURL, urlExpiry), nil
+	case "direct":
+		return images, nil
+	default:
+		return nil, fmt.Errorf("unknown image URL mode %q, expected signed or direct", urlMode)
+	}
+}
+
+// comfyBackends reads the ComfyUI instances from COMFYUI_ADDRESSES, a comma separated list of
+// addresses each optionally followed by |-separated tags ("http://gpu1:8188|flux|sdxl"). Without
+// it the single untagged COMFYUI_ADDRESS is used.
+func comfyBackends(defaultAddr string) []comfy.BackendConfig {
+	var backends []comfy.BackendConfig
+	for _, entry := range strings.Split(os.Getenv("COMFYUI_ADDRESSES"), ",") {
+		parts := strings.Split(strings.TrimSpace(entry), "|")
+		if parts[0] == "" {
+			continue
+		}
+		backend := comfy.BackendConfig{Address: parts[0]}
+		for _, tag := range parts[1:] {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				backend.Tags = append(backend.Tags, tag)
+			}
+		}
+		backends = append(backends, backend)
+	}
+
+	if len(backends) == 0 {
+		backends = append(backends, comfy.BackendConfig{Address: defaultAddr})
+	}
+	return backends
+}
+
+// tenantWeights parses the weights of COMFYLITE_TENANT_WEIGHTS, skipping invalid ones.
+func tenantWeights(pairs map[string]string) map[string]int {
+	weights := make(map[string]int, len(pairs))
+	for tenant, val := range pairs {
+		w, err := strconv.Atoi(val)
+		if err != nil || w <= 0 {
+			log.Printf("Warning: weight %q of tenant %s is not a positive integer, using 1", val, tenant)
+			continue
+		}
+		weights[tenant] = w
+	}
+	return weights
+}
+
+// imageURLSecret returns the key for signing image URLs. Without a configured secret a random one
+// is used, so image links stop working when ComfyLite restarts.
+func imageURLSecret() []byte {
+	if secret := GetEnvOrDefault("COMFYLITE_IMAGE_URL_SECRET", ""); secret != "" {
+		return []byte(secret)
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		log.Fatalf("Failed to generate image URL secret: %v", err)
+	}
+	return secret
+}
+
+// publicURL guesses the address clients reach ComfyLite on from the listen address.
+func publicURL(listenAddr string) string {
+	if strings.HasPrefix(listenAddr, ":") {
+		return "http://localhost" + listenAddr
+	}
+	return "http://" + listenAddr
+}
+
+func GetEnvOrDefault(key string, defaultVal string) string {
+
+	val, exist := os.LookupEnv(key)
+	if !exist {
+		return defaultVal
+	}
+
+	return val
+}
+
+func GetEnvIntOrDefault(key string, defaultVal int) int {
+
+	val, exist := os.LookupEnv(key)
+	if !exist {
+		return defaultVal
+	}
+
+	i, err := strconv.Atoi(val)
+	if err != nil {
+		log.Printf("Warning: %s=%q is not an integer, using default %d", key, val, defaultVal)
+		return defaultVal
+	}
+
+	return i
+}
+
+func GetEnvBoolOrDefault(key string, defaultVal bool) bool {
+
+	val, exist := os.LookupEnv(key)
+	if !exist {
+		return defaultVal
+	}
+
+	b, err := strconv.ParseBool(val)
+	if err != nil {
+		log.Printf("Warning: %s=%q is not a boolean, using default %t", key, val, defaultVal)
+		return defaultVal
+	}
+
+	return b
+}
+
+// GetEnvPairs reads a comma separated list of key=value pairs, such as "a=1,b=2".
+func GetEnvPairs(key string) map[string]string {
+
+	pairs := make(map[string]string)
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(item, "=")
+		if !ok || k == "" {
+			log.Printf("Warning: ignoring malformed entry in %s, expected key=value", key)
+			continue
+		}
+		pairs[k] = v
+	}
+
+	return pairs
+}
+
+func GetEnvDurationOrDefault(key string, defaultVal time.Duration) time.Duration {
+
+	val, exist := os.LookupEnv(key)
+	if !exist {
+		return defaultVal
+	}
+
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		log.Printf("Warning: %s=%q is not a duration, using default %s", key, val, defaultVal)
+		return defaultVal
+	}
+
+	return d
+}
@@ -7,5 +7,6 @@ require (
 	github.com/google/uuid v1.6.0
 	github.com/gorilla/websocket v1.5.3
 	github.com/joho/godotenv v1.5.1
+	golang.org/x/image v0.25.0
 	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,101 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/CP-Payne/comfylite/internal/store"
+	"github.com/CP-Payne/comfylite/internal/tracker"
+	"github.com/go-chi/chi/v5"
+)
+
+// sseKeepAlive is how often a comment is sent on idle streams so proxies do not close them
+const sseKeepAlive = 15 * time.Second
+
+// HandleJobEvents streams a job's progress as Server-Sent Events. The stream opens with the job's
+// current state ("queued" or "started"), followed by "executing", "progress" and "preview" events,
+// and ends with a "result" event carrying the final job.
+func (h *Handler) HandleJobEvents(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	// Watch before reading the job so no update is lost between the two
+	updates, stop, watching := h.service.WatchJob(id)
+	defer stop()
+
+	job, err := h.service.GetJob(r.Context(), id)
+	if errors.Is(err, store.ErrJobNotFound) || err == nil && !ownsJob(r, job) {
+		writeError(w, http.StatusNotFound, "job not found")
+		return
+	}
+	if err != nil {
+		fmt.Printf("failed to get job: %v\n", err)
+		writeError(w, http.StatusInternalServerError, "failed to get job")
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming is not supported")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	if job.Status.Terminal() || !watching {
+		writeEvent(w, flusher, "result", job)
+		return
+	}
+
+	initial := "queued"
+	if job.Status == store.StatusRunning {
+		initial = "started"
+	}
+	writeEvent(w, flusher, initial, job)
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case update, ok := <-updates:
+			if ok && update.Type != tracker.UpdateResult {
+				writeEvent(w, flusher, string(update.Type), update)
+				continue
+			}
+
+			// The tracker is done with the job, send its final state from the store
+			job, err := h.service.GetJob(r.Context(), id)
+			if err != nil {
+				fmt.Printf("failed to get job: %v\n", err)
+				return
+			}
+			writeEvent(w, flusher, "result", job)
+			return
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, flusher http.Flusher, event string, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		fmt.Printf("failed to marshal event data: %v", err)
+		return
+	}
+
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data); err != nil {
+		fmt.Printf("failed to write event to writer: %v", err)
+		return
+	}
+	flusher.Flush()
+}
@@ -1,97 +1,374 @@
-package api
-
-import (
-	"encoding/json"
-	"fmt"
-	"log"
-	"net/http"
-	"time"
-
-	"github.com/CP-Payne/comfylite/internal/service"
-)
-
-const workflowName = "flux"
-
-type Handler struct {
-	service service.Service
-}
-
-func NewHandler(service service.Service) *Handler {
-	return &Handler{
-		service: service,
-	}
-}
-
-func (h *Handler) HandleGenerateImage(w http.ResponseWriter, r *http.Request) {
-
-	var genRequest GenerationRequest
-	err := json.NewDecoder(r.Body).Decode(&genRequest)
-	if err != nil {
-		log.Printf("failed to decode request body")
-		return
-	}
-
-	var response GenerateResponse
-
-	// IMPORTANT: the keys in the prompt must match those specified in the config/<workflow>.yaml
-	promptParams := make(map[string]any)
-
-	if genRequest.Prompt == "" {
-
-		response.Error = "prompt cannot be empty"
-
-		respData, err := json.Marshal(response)
-		if err != nil {
-			fmt.Printf("failed to marshal response data: %v", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-
-		w.WriteHeader(http.StatusBadRequest)
-		if _, err = w.Write(respData); err != nil {
-			fmt.Printf("failed to write response body to writer: %v", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-	}
-	promptParams["prompt"] = genRequest.Prompt
-
-	if genRequest.Height <= 0 {
-		promptParams["height"] = 450
-	}
-	promptParams["height"] = genRequest.Height
-
-	if genRequest.Width <= 0 {
-		promptParams["width"] = 450
-	}
-	promptParams["width"] = genRequest.Height
-
-	if genRequest.ImageCount <= 0 {
-		promptParams["imageCount"] = 1
-	}
-
-	promptParams["imageCount"] = genRequest.ImageCount
-
-	seed := time.Now().UnixNano()
-	promptParams["seed"] = seed
-
-	result, err := h.service.GenerateImage(r.Context(), workflowName, promptParams, genRequest.WebhookURL)
-	if err != nil || result.PromptID == "" {
-		fmt.Printf("failed to generate image: %v\n", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	response.PromptID = result.PromptID
-
-	respData, err := json.Marshal(response)
-	if err != nil {
-		fmt.Printf("failed to marshal response data: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	w.Header().Add("Content-Type", "application/json")
-	w.Write(respData)
-
-}
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/CP-Payne/comfylite/internal/comfy"
+	"github.com/CP-Payne/comfylite/internal/imagestore"
+	"github.com/CP-Payne/comfylite/internal/notifier"
+	"github.com/CP-Payne/comfylite/internal/service"
+	"github.com/CP-Payne/comfylite/internal/store"
+	"github.com/CP-Payne/comfylite/internal/tracker"
+	"github.com/CP-Payne/comfylite/internal/workflow"
+	"github.com/go-chi/chi/v5"
+)
+
+type Handler struct {
+	service         service.Service
+	defaultWorkflow string
+	// syncTimeout caps how long a ?wait=true request blocks for its images
+	syncTimeout time.Duration
+	// imageSigner checks the tokens on /images URLs
+	imageSigner *imagestore.URLSigner
+	// transforms caches resized and converted images, as anyone with a link can request them
+	transforms *imagestore.TransformCache
+}
+
+// transformCacheSize is the memory budget for resized and converted images
+const transformCacheSize = 64 << 20
+
+func NewHandler(service service.Service, defaultWorkflow string, syncTimeout time.Duration, imageSigner *imagestore.URLSigner) *Handler {
+	return &Handler{
+		service:         service,
+		defaultWorkflow: defaultWorkflow,
+		syncTimeout:     syncTimeout,
+		imageSigner:     imageSigner,
+		transforms:      imagestore.NewTransformCache(transformCacheSize),
+	}
+}
+
+// HandleGenerateImage serves both POST /generate and POST /workflows/{name}/generate.
+// The workflow is taken from the URL first, then the request body, then the configured default.
+func (h *Handler) HandleGenerateImage(w http.ResponseWriter, r *http.Request) {
+
+	// Images in the body are held in memory, so the body is capped
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	genRequest, err := decodeGenerationRequest(r)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body is larger than %d MB", maxRequestSize>>20))
+		return
+	}
+	if err != nil {
+		log.Printf("failed to decode request body: %v", err)
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	workflowName := chi.URLParam(r, "name")
+	if workflowName == "" {
+		workflowName = genRequest.Workflow
+	}
+	if workflowName == "" {
+		workflowName = h.defaultWorkflow
+	}
+
+	// IMPORTANT: the keys in the params must match those specified in the config/<workflow>.yaml
+	promptParams := make(map[string]any, len(genRequest.Params))
+	for key, value := range genRequest.Params {
+		promptParams[key] = value
+	}
+
+	// The top-level fields are kept for backwards compatibility, values in params take precedence
+	setIfMissing := func(key string, value any) {
+		if _, ok := promptParams[key]; !ok {
+			promptParams[key] = value
+		}
+	}
+	if genRequest.Prompt != "" {
+		setIfMissing("prompt", genRequest.Prompt)
+	}
+	if genRequest.Width > 0 {
+		setIfMissing("width", genRequest.Width)
+	}
+	if genRequest.Height > 0 {
+		setIfMissing("height", genRequest.Height)
+	}
+	if genRequest.ImageCount > 0 {
+		setIfMissing("imageCount", genRequest.ImageCount)
+	}
+
+	webhook := notifier.Webhook{
+		URL:          genRequest.WebhookURL,
+		Secret:       genRequest.WebhookSecret,
+		InlineImages: genRequest.InlineImages,
+	}
+	opts := service.JobOptions{Tenant: TenantFrom(r.Context()), Priority: genRequest.Priority}
+
+	if wait, _ := strconv.ParseBool(r.URL.Query().Get("wait")); wait {
+		h.generateSync(w, r, workflowName, promptParams, webhook, opts)
+		return
+	}
+
+	result, err := h.service.GenerateImage(r.Context(), workflowName, promptParams, webhook, opts)
+	if writeGenerateError(w, workflowName, err) {
+		return
+	}
+	if result.PromptID == "" {
+		writeError(w, http.StatusInternalServerError, "failed to generate image")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, GenerateResponse{PromptID: result.PromptID, Workflow: workflowName})
+}
+
+// decodeGenerationRequest reads a JSON body, or a multipart/form-data body whose "request" field
+// holds the JSON and whose files are image and mask parameters named after the form field.
+func decodeGenerationRequest(r *http.Request) (GenerationRequest, error) {
+	var genRequest GenerationRequest
+
+	body := r.Body
+	isMultipart := strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data")
+	if isMultipart {
+		if err := r.ParseMultipartForm(maxUploadMemory); err != nil {
+			return genRequest, fmt.Errorf("failed to parse multipart form: %w", err)
+		}
+		body = io.NopCloser(strings.NewReader(r.FormValue("request")))
+	}
+
+	decoder := json.NewDecoder(body)
+	// Keep numbers as json.Number so large integers such as seeds reach ComfyUI unchanged
+	decoder.UseNumber()
+	if err := decoder.Decode(&genRequest); err != nil && !(isMultipart && errors.Is(err, io.EOF)) {
+		return genRequest, err
+	}
+	if !isMultipart {
+		return genRequest, nil
+	}
+
+	if genRequest.Params == nil {
+		genRequest.Params = make(map[string]any)
+	}
+	for name, files := range r.MultipartForm.File {
+		if len(files) != 1 {
+			return genRequest, fmt.Errorf("expected one file for parameter %s, got %d", name, len(files))
+		}
+		data, err := readFormFile(files[0])
+		if err != nil {
+			return genRequest, fmt.Errorf("failed to read file for parameter %s: %w", name, err)
+		}
+		genRequest.Params[name] = workflow.InputImage{
+			Data:        data,
+			ContentType: files[0].Header.Get("Content-Type"),
+			Filename:    files[0].Filename,
+		}
+	}
+	return genRequest, nil
+}
+
+const (
+	// maxRequestSize caps generate request bodies, including base64 and uploaded images
+	maxRequestSize = 64 << 20
+	// maxUploadMemory is how much of a multipart request is kept in memory, the rest goes to temporary files
+	maxUploadMemory = 32 << 20
+)
+
+func readFormFile(header *multipart.FileHeader) ([]byte, error) {
+	file, err := header.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+// generateSync waits for the images and returns them in the format the client accepts: JSON with
+// base64 images by default, the raw image for a single result or multipart/mixed for several when
+// the Accept header asks for images.
+func (h *Handler) generateSync(w http.ResponseWriter, r *http.Request, workflowName string, params map[string]any, webhook notifier.Webhook, opts service.JobOptions) {
+	ctx, cancel := context.WithTimeout(r.Context(), h.syncTimeout)
+	defer cancel()
+
+	result, err := h.service.GenerateImageSync(ctx, workflowName, params, webhook, opts)
+	if result == nil {
+		if !writeGenerateError(w, workflowName, err) {
+			writeError(w, http.StatusInternalServerError, "failed to generate image")
+		}
+		return
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		// The job keeps running, the client can follow up on /jobs/{id}
+		writeJSON(w, http.StatusGatewayTimeout, GenerateResponse{PromptID: result.PromptID, Workflow: workflowName, Error: "timed out waiting for images"})
+		return
+	}
+	// ComfyUI rejected the prompt after it left the queue
+	var promptErr *comfy.PromptValidationError
+	if errors.As(err, &promptErr) {
+		writeJSON(w, http.StatusBadRequest, GenerateResponse{PromptID: result.PromptID, Workflow: workflowName, Error: promptErr.Error(), NodeErrors: promptErr.Errors})
+		return
+	}
+	if err != nil {
+		fmt.Printf("failed to generate image: %v\n", err)
+		writeJSON(w, http.StatusInternalServerError, GenerateResponse{PromptID: result.PromptID, Workflow: workflowName, Error: err.Error()})
+		return
+	}
+
+	w.Header().Set("X-Prompt-ID", result.PromptID)
+
+	accept := r.Header.Get("Accept")
+	wantsImages := strings.Contains(accept, "image/") || strings.Contains(accept, "multipart/mixed")
+	switch {
+	case wantsImages && len(result.Images) == 1:
+		w.Header().Set("Content-Type", contentType(result.Images[0]))
+		w.WriteHeader(http.StatusOK)
+		if _, err := w.Write(result.Images[0].Data); err != nil {
+			fmt.Printf("failed to write image to writer: %v", err)
+		}
+
+	case wantsImages:
+		writeMultipart(w, result.Images)
+
+	default:
+		encoded := make([]string, 0, len(result.Images))
+		for _, image := range result.Images {
+			encoded = append(encoded, base64.StdEncoding.EncodeToString(image.Data))
+		}
+		writeJSON(w, http.StatusOK, GenerateResponse{PromptID: result.PromptID, Workflow: workflowName, Images: encoded})
+	}
+}
+
+// writeGenerateError maps errors from the service to responses and reports whether one was written.
+func writeGenerateError(w http.ResponseWriter, workflowName string, err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, workflow.ErrWorkflowNotFound) {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("workflow %q not found", workflowName))
+		return true
+	}
+	var validationErr *workflow.ValidationError
+	if errors.As(err, &validationErr) {
+		writeJSON(w, http.StatusBadRequest, GenerateResponse{Error: validationErr.Error(), Fields: validationErr.Fields})
+		return true
+	}
+	var promptErr *comfy.PromptValidationError
+	if errors.As(err, &promptErr) {
+		writeJSON(w, http.StatusBadRequest, GenerateResponse{Error: promptErr.Error(), NodeErrors: promptErr.Errors})
+		return true
+	}
+	if errors.Is(err, comfy.ErrNoBackend) {
+		writeError(w, http.StatusServiceUnavailable, fmt.Sprintf("no ComfyUI backend can run workflow %q", workflowName))
+		return true
+	}
+	var queueFullErr *service.QueueFullError
+	if errors.As(err, &queueFullErr) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(queueFullErr.RetryAfter.Seconds()))))
+		// A tenant over its own limit is rate limited, a full queue means the whole service is busy
+		if queueFullErr.Tenant != "" {
+			writeError(w, http.StatusTooManyRequests, "too many queued jobs for this API key")
+		} else {
+			writeError(w, http.StatusServiceUnavailable, "job queue is full")
+		}
+		return true
+	}
+
+	fmt.Printf("failed to generate image: %v\n", err)
+	writeError(w, http.StatusInternalServerError, "failed to generate image")
+	return true
+}
+
+// contentType returns the image's MIME type, sniffing it if ComfyUI did not say.
+func contentType(image tracker.Image) string {
+	if image.ContentType != "" {
+		return image.ContentType
+	}
+	return http.DetectContentType(image.Data)
+}
+
+func writeMultipart(w http.ResponseWriter, images []tracker.Image) {
+	mw := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	w.WriteHeader(http.StatusOK)
+
+	for i, image := range images {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", contentType(image))
+		header.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="image_%d%s"`, i, imagestore.Extension(contentType(image))))
+		part, err := mw.CreatePart(header)
+		if err != nil {
+			fmt.Printf("failed to create multipart part: %v", err)
+			return
+		}
+		if _, err := part.Write(image.Data); err != nil {
+			fmt.Printf("failed to write image to writer: %v", err)
+			return
+		}
+	}
+
+	if err := mw.Close(); err != nil {
+		fmt.Printf("failed to close multipart writer: %v", err)
+	}
+}
+
+func (h *Handler) HandleGetJob(w http.ResponseWriter, r *http.Request) {
+	job, err := h.service.GetJob(r.Context(), chi.URLParam(r, "id"))
+	if errors.Is(err, store.ErrJobNotFound) || err == nil && !ownsJob(r, job) {
+		writeError(w, http.StatusNotFound, "job not found")
+		return
+	}
+	if err != nil {
+		fmt.Printf("failed to get job: %v\n", err)
+		writeError(w, http.StatusInternalServerError, "failed to get job")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, job)
+}
+
+func (h *Handler) HandleCancelJob(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	job, err := h.service.GetJob(r.Context(), id)
+	if err == nil && !ownsJob(r, job) {
+		err = store.ErrJobNotFound
+	}
+	if err == nil {
+		job, err = h.service.CancelJob(r.Context(), id)
+	}
+	if errors.Is(err, store.ErrJobNotFound) {
+		writeError(w, http.StatusNotFound, "job not found")
+		return
+	}
+	if errors.Is(err, service.ErrJobFinished) {
+		writeJSON(w, http.StatusConflict, map[string]any{"error": "job already finished", "job": job})
+		return
+	}
+	if err != nil {
+		fmt.Printf("failed to cancel job: %v\n", err)
+		writeError(w, http.StatusInternalServerError, "failed to cancel job")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, job)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	respData, err := json.Marshal(v)
+	if err != nil {
+		fmt.Printf("failed to marshal response data: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if _, err = w.Write(respData); err != nil {
+		fmt.Printf("failed to write response body to writer: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, GenerateResponse{Error: message})
+}
@@ -0,0 +1,46 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/CP-Payne/comfylite/internal/service"
+)
+
+func TestWriteGenerateErrorQueueFull(t *testing.T) {
+	tests := []struct {
+		name           string
+		err            error
+		wantStatus     int
+		wantRetryAfter string
+	}{
+		{
+			name:           "whole queue",
+			err:            &service.QueueFullError{RetryAfter: 30 * time.Second},
+			wantStatus:     http.StatusServiceUnavailable,
+			wantRetryAfter: "30",
+		},
+		{
+			name:           "tenant limit",
+			err:            &service.QueueFullError{RetryAfter: 1500 * time.Millisecond, Tenant: "batch"},
+			wantStatus:     http.StatusTooManyRequests,
+			wantRetryAfter: "2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			if !writeGenerateError(w, "flux", tt.err) {
+				t.Fatalf("writeGenerateError() = false, want true")
+			}
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if got := w.Header().Get("Retry-After"); got != tt.wantRetryAfter {
+				t.Errorf("Retry-After = %q, want %q", got, tt.wantRetryAfter)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/CP-Payne/comfylite/internal/imagestore"
+	"github.com/go-chi/chi/v5"
+)
+
+// HandleGetImage serves GET /images/{id}. The URL must carry a valid expires/sig token. The
+// optional w, h, format (png, jpeg, gif) and q (JPEG quality) parameters resize or convert the
+// image on the fly; range requests and conditional requests are handled by http.ServeContent.
+func (h *Handler) HandleGetImage(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	query := r.URL.Query()
+
+	err := h.imageSigner.Verify(id, query, time.Now())
+	if errors.Is(err, imagestore.ErrURLExpired) {
+		writeError(w, http.StatusForbidden, "image URL expired")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusForbidden, "invalid image URL signature")
+		return
+	}
+
+	width, errW := optionalInt(query.Get("w"))
+	height, errH := optionalInt(query.Get("h"))
+	quality, errQ := optionalInt(query.Get("q"))
+	if errW != nil || errH != nil || errQ != nil {
+		writeError(w, http.StatusBadRequest, "w, h and q must be positive integers")
+		return
+	}
+	format := query.Get("format")
+
+	load := func() ([]byte, error) { return h.service.GetImage(r.Context(), id) }
+	var data []byte
+	contentType := imagestore.ContentType(id)
+	if width != 0 || height != 0 || format != "" {
+		data, contentType, err = h.transforms.Transform(id, load, width, height, format, quality)
+	} else {
+		data, err = load()
+	}
+	if errors.Is(err, imagestore.ErrNotFound) {
+		writeError(w, http.StatusNotFound, "image not found")
+		return
+	}
+	if errors.Is(err, imagestore.ErrInvalidTransform) {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		fmt.Printf("failed to get image: %v\n", err)
+		writeError(w, http.StatusInternalServerError, "failed to get image")
+		return
+	}
+
+	sum := sha256.Sum256(data)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	// The token is valid until it expires, browsers may keep the image that long
+	if expires, err := strconv.ParseInt(query.Get("expires"), 10, 64); err == nil {
+		w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", max(0, expires-time.Now().Unix())))
+	}
+
+	http.ServeContent(w, r, id, time.Time{}, bytes.NewReader(data))
+}
+
+func optionalInt(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	i, err := strconv.Atoi(s)
+	if err != nil || i <= 0 {
+		return 0, fmt.Errorf("invalid value %q", s)
+	}
+	return i, nil
+}
@@ -0,0 +1,63 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/CP-Payne/comfylite/internal/store"
+)
+
+const (
+	// APIKeyHeader carries the key that identifies a request's tenant
+	APIKeyHeader = "X-API-Key"
+	// DefaultTenant is used for every request when no API keys are configured
+	DefaultTenant = "default"
+)
+
+type tenantKey struct{}
+
+// RequireAPIKey resolves the tenant of each request from its X-API-Key header. keys maps API keys
+// to tenant names; requests without a known key are rejected with 401. When keys is empty every
+// request belongs to DefaultTenant.
+func RequireAPIKey(keys map[string]string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tenant := DefaultTenant
+			if len(keys) > 0 {
+				var ok bool
+				if tenant, ok = lookupKey(keys, r.Header.Get(APIKeyHeader)); !ok {
+					writeError(w, http.StatusUnauthorized, "missing or invalid API key")
+					return
+				}
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tenantKey{}, tenant)))
+		})
+	}
+}
+
+// lookupKey compares against every key in constant time so response times do not leak keys.
+func lookupKey(keys map[string]string, presented string) (string, bool) {
+	var tenant string
+	found := false
+	for key, name := range keys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(presented)) == 1 {
+			tenant, found = name, true
+		}
+	}
+	return tenant, found
+}
+
+// TenantFrom returns the tenant RequireAPIKey stored in ctx, or DefaultTenant.
+func TenantFrom(ctx context.Context) string {
+	if tenant, ok := ctx.Value(tenantKey{}).(string); ok {
+		return tenant
+	}
+	return DefaultTenant
+}
+
+// ownsJob reports whether the job belongs to the request's tenant. Handlers answer 404 for jobs of
+// other tenants, so job IDs cannot be probed across tenants.
+func ownsJob(r *http.Request, job *store.Job) bool {
+	return job.Tenant == TenantFrom(r.Context())
+}
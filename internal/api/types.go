@@ -1,14 +1,51 @@
-package api
-
-type GenerationRequest struct {
-	Prompt     string `json:"prompt"`
-	ImageCount int    `json:"image_count"`
-	Width      int    `json:"width"`
-	Height     int    `json:"height"`
-	WebhookURL string `json:"webhook_url"`
-}
-
-type GenerateResponse struct {
-	PromptID string `json:"prompt_id"`
-	Error    string `json:"error,omitempty"`
-}
+package api
+
+import (
+	"github.com/CP-Payne/comfylite/internal/comfy"
+	"github.com/CP-Payne/comfylite/internal/workflow"
+)
+
+type GenerationRequest struct {
+	Workflow   string `json:"workflow"`
+	Prompt     string `json:"prompt"`
+	ImageCount int    `json:"image_count"`
+	Width      int    `json:"width"`
+	Height     int    `json:"height"`
+	WebhookURL string `json:"webhook_url"`
+	// WebhookSecret overrides the server's default webhook signing secret for this request
+	WebhookSecret string `json:"webhook_secret"`
+	// InlineImages adds base64 images to the webhook even when an image store is configured
+	InlineImages bool `json:"inline_images"`
+
+	// Priority orders this tenant's queued jobs, higher runs first
+	Priority int `json:"priority"`
+
+	// Params holds workflow parameters keyed by their name in configs/<workflow>.yaml
+	Params map[string]any `json:"params"`
+}
+
+type GenerateResponse struct {
+	PromptID string `json:"prompt_id,omitempty"`
+	Workflow string `json:"workflow,omitempty"`
+	// Images holds base64 encoded images for synchronous requests
+	Images []string              `json:"images,omitempty"`
+	Error  string                `json:"error,omitempty"`
+	Fields []workflow.FieldError `json:"fields,omitempty"`
+	// NodeErrors lists the workflow nodes ComfyUI cannot run as built
+	NodeErrors []comfy.NodeError `json:"node_errors,omitempty"`
+}
+
+// WorkflowSummary is an entry of GET /workflows.
+type WorkflowSummary struct {
+	Name string `json:"name"`
+	// Default is set on the workflow used when a request does not name one
+	Default  bool     `json:"default,omitempty"`
+	Params   []string `json:"params"`
+	Requires []string `json:"requires,omitempty"`
+	// Error is set when the workflow's config or template cannot be loaded
+	Error string `json:"error,omitempty"`
+}
+
+type WorkflowListResponse struct {
+	Workflows []WorkflowSummary `json:"workflows"`
+}
@@ -0,0 +1,61 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/CP-Payne/comfylite/internal/workflow"
+	"github.com/go-chi/chi/v5"
+)
+
+// HandleListWorkflows lists every workflow with a template and a config.
+func (h *Handler) HandleListWorkflows(w http.ResponseWriter, r *http.Request) {
+	names, err := h.service.Workflows()
+	if err != nil {
+		fmt.Printf("failed to list workflows: %v\n", err)
+		writeError(w, http.StatusInternalServerError, "failed to list workflows")
+		return
+	}
+
+	resp := WorkflowListResponse{Workflows: make([]WorkflowSummary, 0, len(names))}
+	for _, name := range names {
+		summary := WorkflowSummary{Name: name, Default: name == h.defaultWorkflow, Params: []string{}}
+		desc, err := h.service.DescribeWorkflow(name)
+		if err != nil {
+			// A broken workflow is still listed so it can be spotted and fixed
+			summary.Error = err.Error()
+			resp.Workflows = append(resp.Workflows, summary)
+			continue
+		}
+		if properties, ok := desc.Params["properties"].(map[string]any); ok {
+			for param := range properties {
+				summary.Params = append(summary.Params, param)
+			}
+			slices.Sort(summary.Params)
+		}
+		summary.Requires = desc.Requires
+		resp.Workflows = append(resp.Workflows, summary)
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// HandleGetWorkflow describes a workflow's parameters as a JSON Schema, along with its outputs and
+// the node classes and models it needs.
+func (h *Handler) HandleGetWorkflow(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	desc, err := h.service.DescribeWorkflow(name)
+	if errors.Is(err, workflow.ErrWorkflowNotFound) {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("workflow %q not found", name))
+		return
+	}
+	if err != nil {
+		fmt.Printf("failed to describe workflow %s: %v\n", name, err)
+		writeError(w, http.StatusInternalServerError, "failed to describe workflow")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, desc)
+}
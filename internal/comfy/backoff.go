@@ -0,0 +1,34 @@
+package comfy
+
+import (
+	"context"
+	"math/rand/v2"
+	"time"
+)
+
+const (
+	backoffBase = 500 * time.Millisecond
+	backoffMax  = 30 * time.Second
+)
+
+// backoff returns an exponential delay with full jitter for the given zero-based attempt.
+func backoff(attempt int) time.Duration {
+	ceiling := backoffMax
+	if attempt < 16 {
+		ceiling = min(backoffBase<<attempt, backoffMax)
+	}
+	return time.Duration(rand.Int64N(int64(ceiling)) + 1)
+}
+
+// sleepCtx waits for d and reports false if ctx was cancelled first.
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -1,161 +1,412 @@
-package comfy
-
-import (
-	"bytes"
-	"context"
-	"encoding/json"
-	"fmt"
-	"log"
-	"net/http"
-	"net/url"
-
-	"github.com/CP-Payne/comfylite/internal/tracker"
-	"github.com/gorilla/websocket"
-)
-
-type Event struct {
-	Type string      `json:"type"`
-	Data interface{} `json:"data"`
-}
-
-type promptRequest struct {
-	Prompt   json.RawMessage `json:"prompt"`
-	ClientID string          `json:"client_id"`
-}
-
-type promptResponse struct {
-	PromptID   string         `json:"prompt_id"`
-	Number     int            `json:"number"`
-	NodeErrors map[string]any `json:"node_errors"`
-}
-
-type Client interface {
-	Start(ctx context.Context, eventChan chan<- tracker.Event) error
-	Submit(workflow []byte) (string, error)
-}
-
-type client struct {
-	baseURL    string
-	clientID   string
-	httpClient *http.Client
-	conn       *websocket.Conn
-}
-
-func NewClient(baseURL, clientID string) Client {
-	return &client{
-		baseURL:    baseURL,
-		clientID:   clientID,
-		httpClient: &http.Client{},
-	}
-}
-
-func (c *client) Start(ctx context.Context, eventChan chan<- tracker.Event) error {
-
-	u, _ := url.Parse(c.baseURL)
-	wsURL := fmt.Sprintf("ws://%s/ws?clientId=%s", u.Host, c.clientID)
-
-	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
-	if err != nil {
-		return err
-	}
-
-	c.conn = conn
-
-	go c.dispatcher(ctx, eventChan)
-
-	return nil
-}
-
-func (c *client) dispatcher(_ context.Context, eventChan chan<- tracker.Event) {
-	defer c.conn.Close()
-
-	for {
-		msgType, rawMsg, err := c.conn.ReadMessage()
-		if err != nil {
-			log.Printf("Failed reading message: %v", err)
-			continue
-		}
-
-		switch msgType {
-		case websocket.TextMessage:
-			var comfyEvent Event
-			err := json.Unmarshal(rawMsg, &comfyEvent)
-			if err != nil {
-				log.Printf("Error: failed to unmarshal comfy event: %v", err)
-				continue
-			}
-
-			dataMap, ok := comfyEvent.Data.(map[string]interface{})
-			if !ok {
-				log.Printf("Warn: data field missing or not a map")
-				continue
-			}
-
-			promptID, ok := dataMap["prompt_id"].(string)
-			if !ok {
-				// Not all events contain prompt_id, ignore those for now
-				// log.Printf("Warn: prompt_id field missing or not a string")
-				continue
-			}
-
-			var internalEvent tracker.Event
-
-			switch comfyEvent.Type {
-			case "execution_start":
-				internalEvent = tracker.Event{Type: tracker.EventExecutionStart, PromptID: promptID}
-			case "execution_success":
-				internalEvent = tracker.Event{Type: tracker.EventExecutionFinished, PromptID: promptID}
-			case "executing":
-				internalEvent = tracker.Event{Type: tracker.EventExecuting, PromptID: promptID}
-			case "progress":
-				internalEvent = tracker.Event{Type: tracker.EventProgress, PromptID: promptID}
-
-				// TODO: Add event types for "execution_interupted" and determin if there is a type for errors
-			}
-
-			eventChan <- internalEvent
-
-		case websocket.BinaryMessage:
-			eventChan <- tracker.Event{Type: tracker.EventImageReceived, Data: rawMsg[8:]}
-		default:
-			log.Println("Unknown message type: ", msgType)
-
-		}
-
-	}
-}
-
-func (c *client) Submit(workflow []byte) (string, error) {
-
-	reqPayload := promptRequest{
-		Prompt:   json.RawMessage(workflow),
-		ClientID: c.clientID,
-	}
-
-	reqBody, err := json.Marshal(reqPayload)
-	if err != nil {
-		return "", fmt.Errorf("failed to marshal prompt request: %w", err)
-	}
-
-	endpoint := c.baseURL + "/prompt"
-	resp, err := c.httpClient.Post(endpoint, "application/json", bytes.NewBuffer(reqBody))
-	if err != nil {
-		return "", fmt.Errorf("failed to submit prompt: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("received non-200 status from ComfyUI: %s", resp.Status)
-	}
-
-	var promptResp promptResponse
-	if err := json.NewDecoder(resp.Body).Decode(&promptResp); err != nil {
-		return "", fmt.Errorf("failed to decode prompt response: %w", err)
-	}
-
-	if len(promptResp.NodeErrors) != 0 {
-		fmt.Printf("WARN: node errors is not nil: %v\n", promptResp.NodeErrors)
-	}
-
-	return promptResp.PromptID, nil
-}
+package comfy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/CP-Payne/comfylite/internal/tracker"
+	"github.com/gorilla/websocket"
+)
+
+type Event struct {
+	Type string      `json:"type"`
+	Data interface{} `json:"data"`
+}
+
+type promptRequest struct {
+	Prompt   json.RawMessage `json:"prompt"`
+	ClientID string          `json:"client_id"`
+	PromptID string          `json:"prompt_id"`
+}
+
+type promptResponse struct {
+	PromptID   string          `json:"prompt_id"`
+	Number     int             `json:"number"`
+	NodeErrors comfyNodeErrors `json:"node_errors"`
+}
+
+// promptErrorResponse is ComfyUI's answer to a prompt it rejects.
+type promptErrorResponse struct {
+	Error struct {
+		Message string `json:"message"`
+		Details string `json:"details"`
+	} `json:"error"`
+	NodeErrors comfyNodeErrors `json:"node_errors"`
+}
+
+// Client talks to one or more ComfyUI instances. Prompts are identified by their prompt ID alone,
+// the client remembers which instance runs them.
+type Client interface {
+	Start(ctx context.Context, eventChan chan<- tracker.Event) error
+	// Submit queues the workflow in ComfyUI under promptID, which lets callers track a prompt
+	// before ComfyUI has accepted it. It returns the address of the instance that took it.
+	Submit(promptID string, workflow []byte, opts SubmitOptions) (string, error)
+	// Adopt takes over a prompt that was submitted to the instance at backend before a restart.
+	// Called before Start, the prompt is reconciled against /queue and /history once connected,
+	// like prompts in flight during a reconnect. It returns false if backend is not configured.
+	Adopt(promptID, backend string) bool
+	// CanRun reports whether any configured instance has all the required tags, healthy or not.
+	CanRun(requires []string) bool
+	// Validate checks a built workflow against the node classes ComfyUI reports in /object_info.
+	// Invalid workflows are reported as a *PromptValidationError.
+	Validate(ctx context.Context, workflow []byte, requires []string) error
+	// UploadImage stores an input image in ComfyUI and returns the name LoadImage knows it by.
+	UploadImage(ctx context.Context, upload Upload, requires []string) (string, error)
+	Dequeue(ctx context.Context, promptIDs ...string) error
+	Interrupt(ctx context.Context, promptID string) error
+	// Abandon stops an earlier attempt of a prompt before it is submitted again under the same ID.
+	// The attempt is removed from the queue or interrupted, and the backend stops reporting on it
+	// once ComfyUI no longer lists it. Unknown prompts are ignored.
+	Abandon(ctx context.Context, promptID string) error
+}
+
+// SubmitOptions restricts which ComfyUI instances a prompt may be sent to.
+type SubmitOptions struct {
+	// Requires lists tags the instance must have
+	Requires []string
+	// Avoid lists instance addresses to use only if no other instance is available, such as
+	// the ones a retried prompt already failed on
+	Avoid []string
+}
+
+// ErrPromptNotOwned is returned when no backend is known to run a prompt, e.g. because it
+// already finished or was submitted by a previous run that did not adopt it.
+var ErrPromptNotOwned = errors.New("no ComfyUI backend is running the prompt")
+
+// ErrPromptRejected is returned when ComfyUI refuses a workflow as invalid.
+var ErrPromptRejected = errors.New("ComfyUI rejected the prompt")
+
+// startAttempts is how many times Start tries to reach ComfyUI before giving up
+const startAttempts = 5
+
+// client is a single ComfyUI instance with its own websocket.
+type client struct {
+	baseURL    string
+	clientID   string
+	tags       []string
+	httpClient *http.Client
+	conn       *websocket.Conn
+
+	// inFlight holds prompts submitted by this client that have not reported a terminal event yet.
+	// They are reconciled against /history after a reconnect.
+	inFlight    map[string]time.Time
+	inFlightMux sync.Mutex
+
+	// Health and load as seen by the pool, guarded by stateMux
+	stateMux  sync.Mutex
+	connected bool
+	checkErr  error
+	load      backendLoad
+
+	objectInfoCache objectInfoCache
+}
+
+func newClient(baseURL, clientID string, tags []string) *client {
+	return &client{
+		baseURL:    baseURL,
+		clientID:   clientID,
+		tags:       tags,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+		inFlight:   make(map[string]time.Time),
+	}
+}
+
+// connect dials the websocket, always re-using the same clientId so ComfyUI keeps routing
+// events for prompts submitted before a reconnect to this client.
+func (c *client) connect() error {
+	u, err := url.Parse(c.baseURL)
+	if err != nil {
+		return fmt.Errorf("invalid ComfyUI address: %w", err)
+	}
+	scheme := "ws"
+	if u.Scheme == "https" {
+		scheme = "wss"
+	}
+	wsURL := fmt.Sprintf("%s://%s/ws?clientId=%s", scheme, u.Host, c.clientID)
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		return err
+	}
+
+	c.conn = conn
+	return nil
+}
+
+// run dispatches events until the socket dies, then reconnects with backoff and resyncs
+// in-flight prompts. connected tells whether connect already succeeded; if not, run keeps trying
+// in the background. It only returns once ctx is cancelled.
+func (c *client) run(ctx context.Context, eventChan chan<- tracker.Event, connected bool) {
+	for {
+		if connected {
+			c.resync(ctx, eventChan)
+
+			err := c.dispatcher(ctx, eventChan)
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("ComfyUI websocket to %s lost: %v. Reconnecting.", c.baseURL, err)
+		}
+
+		for attempt := 0; ; attempt++ {
+			if !sleepCtx(ctx, backoff(attempt)) {
+				return
+			}
+			if err := c.connect(); err != nil {
+				log.Printf("Reconnect attempt %d to %s failed: %v", attempt+1, c.baseURL, err)
+				continue
+			}
+			log.Printf("Connected to ComfyUI websocket at %s.", c.baseURL)
+			break
+		}
+		connected = true
+	}
+}
+
+// dispatcher reads from the current connection until it fails and returns the read error.
+func (c *client) dispatcher(ctx context.Context, eventChan chan<- tracker.Event) error {
+	conn := c.conn
+	defer conn.Close()
+
+	c.setConnected(true)
+	defer c.setConnected(false)
+
+	// Unblock ReadMessage when the context is cancelled
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	// Most binary frames carry no prompt ID, so they are attributed to the prompt and node named by
+	// the most recent executing event on this connection. ComfyUI runs one prompt at a time per instance.
+	var executingPromptID, executingNode string
+	// cachedNodes holds the nodes of each prompt that ComfyUI served from its cache and that have
+	// not sent an executed event since
+	cachedNodes := make(map[string][]string)
+
+	for {
+		msgType, rawMsg, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+
+		switch msgType {
+		case websocket.TextMessage:
+			var comfyEvent Event
+			err := json.Unmarshal(rawMsg, &comfyEvent)
+			if err != nil {
+				log.Printf("Error: failed to unmarshal comfy event: %v", err)
+				continue
+			}
+
+			dataMap, ok := comfyEvent.Data.(map[string]interface{})
+			if !ok {
+				log.Printf("Warn: data field missing or not a map")
+				continue
+			}
+
+			promptID, ok := dataMap["prompt_id"].(string)
+			if !ok {
+				// Not all events contain prompt_id, ignore those for now
+				// log.Printf("Warn: prompt_id field missing or not a string")
+				continue
+			}
+			// A retried prompt keeps its ID, so events from an instance it was moved away from are dropped
+			if !c.owns(promptID) {
+				continue
+			}
+
+			// node is null once a prompt has finished executing
+			node, _ := dataMap["node"].(string)
+
+			var internalEvent tracker.Event
+
+			switch comfyEvent.Type {
+			case "execution_start":
+				executingPromptID, executingNode = promptID, ""
+				internalEvent = tracker.Event{Type: tracker.EventExecutionStart, PromptID: promptID}
+			case "execution_success":
+				if nodes := cachedNodes[promptID]; len(nodes) > 0 {
+					c.sendCachedOutputs(ctx, eventChan, promptID, nodes)
+				}
+				delete(cachedNodes, promptID)
+				c.untrack(promptID)
+				internalEvent = tracker.Event{Type: tracker.EventExecutionFinished, PromptID: promptID}
+			case "executing":
+				executingPromptID, executingNode = promptID, node
+				internalEvent = tracker.Event{Type: tracker.EventExecuting, PromptID: promptID, Node: node}
+			case "progress":
+				value, _ := dataMap["value"].(float64)
+				maxValue, _ := dataMap["max"].(float64)
+				internalEvent = tracker.Event{Type: tracker.EventProgress, PromptID: promptID, Node: node, Data: tracker.Progress{Value: int(value), Max: int(maxValue)}}
+			case "execution_error":
+				delete(cachedNodes, promptID)
+				c.untrack(promptID)
+				execErr := executionErrorFrom(dataMap)
+				internalEvent = tracker.Event{Type: tracker.EventJobFailed, PromptID: promptID, Node: execErr.NodeID, Data: execErr}
+			case "execution_interrupted":
+				delete(cachedNodes, promptID)
+				c.untrack(promptID)
+				execErr := executionErrorFrom(dataMap)
+				execErr.Interrupted = true
+				internalEvent = tracker.Event{Type: tracker.EventExecutionInterrupted, PromptID: promptID, Node: execErr.NodeID, Data: execErr}
+			case "execution_cached":
+				nodes := stringSlice(dataMap["nodes"])
+				cachedNodes[promptID] = append(cachedNodes[promptID], nodes...)
+				internalEvent = tracker.Event{Type: tracker.EventExecutionCached, PromptID: promptID, Data: nodes}
+			case "executed":
+				cachedNodes[promptID] = slices.DeleteFunc(cachedNodes[promptID], func(n string) bool { return n == node })
+				// Files written by SaveImage and similar nodes are fetched before reading on, so they
+				// reach the tracker ahead of the execution_success that follows
+				c.sendOutputs(ctx, eventChan, promptID, node, outputImagesFrom(dataMap["output"]))
+				continue
+			default:
+				continue
+			}
+
+			eventChan <- internalEvent
+
+		case websocket.BinaryMessage:
+			f, err := parseFrame(rawMsg)
+			if err != nil {
+				log.Printf("Warn: dropping binary frame: %v", err)
+				continue
+			}
+			if f.image.Data == nil {
+				continue
+			}
+			promptID, node := f.promptID, f.node
+			if promptID == "" {
+				promptID, node = executingPromptID, executingNode
+			}
+			if promptID == "" {
+				log.Println("Warn: received binary data before any executing event, dropping it")
+				continue
+			}
+			if !c.owns(promptID) {
+				continue
+			}
+			eventChan <- tracker.Event{Type: tracker.EventImageReceived, PromptID: promptID, Node: node, Data: f.image}
+		default:
+			log.Println("Unknown message type: ", msgType)
+
+		}
+
+	}
+}
+
+func (c *client) submit(promptID string, workflow []byte) error {
+
+	reqPayload := promptRequest{
+		Prompt:   json.RawMessage(workflow),
+		ClientID: c.clientID,
+		PromptID: promptID,
+	}
+
+	reqBody, err := json.Marshal(reqPayload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal prompt request: %w", err)
+	}
+
+	// Track the prompt before ComfyUI answers, its first events can arrive before the response
+	c.inFlightMux.Lock()
+	c.inFlight[promptID] = time.Now()
+	c.inFlightMux.Unlock()
+
+	if err := c.post(promptID, reqBody); err != nil {
+		c.untrack(promptID)
+		return err
+	}
+	return nil
+}
+
+func (c *client) post(promptID string, reqBody []byte) error {
+	endpoint := c.baseURL + "/prompt"
+	resp, err := c.httpClient.Post(endpoint, "application/json", bytes.NewBuffer(reqBody))
+	if err != nil {
+		return fmt.Errorf("failed to submit prompt: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusBadRequest {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		var errResp promptErrorResponse
+		if err := json.Unmarshal(body, &errResp); err != nil {
+			return fmt.Errorf("%w: %s", ErrPromptRejected, bytes.TrimSpace(body))
+		}
+		if validationErr := promptErrorFrom(errResp.NodeErrors); validationErr != nil {
+			return validationErr
+		}
+		msg := errResp.Error.Message
+		if errResp.Error.Details != "" {
+			msg += ": " + errResp.Error.Details
+		}
+		return fmt.Errorf("%w: %s", ErrPromptRejected, msg)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("received non-200 status from ComfyUI: %s", resp.Status)
+	}
+
+	var promptResp promptResponse
+	if err := json.NewDecoder(resp.Body).Decode(&promptResp); err != nil {
+		return fmt.Errorf("failed to decode prompt response: %w", err)
+	}
+
+	// ComfyUI still queues a prompt if only some of its outputs are invalid, those are skipped
+	if validationErr := promptErrorFrom(promptResp.NodeErrors); validationErr != nil {
+		log.Printf("ComfyUI skips invalid outputs of prompt %s: %v", promptID, validationErr)
+	}
+
+	// ComfyUI versions that predate client supplied IDs ignore prompt_id and generate their own.
+	// Such a prompt could never be tracked, so it is taken out of the queue again.
+	if promptResp.PromptID != promptID {
+		if err := c.Dequeue(context.Background(), promptResp.PromptID); err != nil {
+			log.Printf("Failed to dequeue untrackable prompt %s: %v", promptResp.PromptID, err)
+		}
+		return fmt.Errorf("ComfyUI assigned prompt ID %s instead of %s, client supplied prompt IDs are not supported by this ComfyUI version", promptResp.PromptID, promptID)
+	}
+
+	return nil
+}
+
+func (c *client) untrack(promptID string) {
+	c.inFlightMux.Lock()
+	delete(c.inFlight, promptID)
+	c.inFlightMux.Unlock()
+}
+
+// executionErrorFrom reads the fields shared by ComfyUI's execution_error and execution_interrupted events.
+func executionErrorFrom(data map[string]interface{}) *tracker.ExecutionError {
+	execErr := &tracker.ExecutionError{Traceback: stringSlice(data["traceback"])}
+	execErr.NodeID, _ = data["node_id"].(string)
+	execErr.NodeType, _ = data["node_type"].(string)
+	execErr.ExceptionType, _ = data["exception_type"].(string)
+	execErr.Message, _ = data["exception_message"].(string)
+	return execErr
+}
+
+func stringSlice(v interface{}) []string {
+	items, _ := v.([]interface{})
+	strs := make([]string, 0, len(items))
+	for _, item := range items {
+		if s, ok := item.(string); ok {
+			strs = append(strs, s)
+		}
+	}
+	return strs
+}
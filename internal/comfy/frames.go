@@ -0,0 +1,80 @@
+package comfy
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+
+	"github.com/CP-Payne/comfylite/internal/tracker"
+)
+
+// Event types in the first four bytes of ComfyUI's binary websocket frames, big-endian.
+const (
+	// framePreviewImage is followed by a 4 byte image format and the image
+	framePreviewImage uint32 = 1
+	// frameText carries progress text of a node
+	frameText uint32 = 3
+	// framePreviewImageWithMetadata is followed by a 4 byte metadata length, JSON metadata and the image
+	framePreviewImageWithMetadata uint32 = 4
+)
+
+// imageFormats maps the image format of a framePreviewImage to its MIME type.
+var imageFormats = map[uint32]string{
+	1: "image/jpeg",
+	2: "image/png",
+	3: "image/webp",
+}
+
+// frame is a decoded binary websocket frame. ComfyUI sends both sampler previews and the images
+// of SaveImageWebsocket this way, which one it is depends on the node that sent it.
+type frame struct {
+	eventType uint32
+	image     tracker.Image
+	// promptID and node are only known for framePreviewImageWithMetadata
+	promptID string
+	node     string
+}
+
+// parseFrame decodes the header of a binary frame. Frames that carry no image, such as frameText,
+// are returned with an empty image.
+func parseFrame(raw []byte) (*frame, error) {
+	if len(raw) < 4 {
+		return nil, fmt.Errorf("binary frame of %d bytes is too short", len(raw))
+	}
+	f := &frame{eventType: binary.BigEndian.Uint32(raw)}
+	body := raw[4:]
+
+	switch f.eventType {
+	case framePreviewImage:
+		if len(body) < 4 {
+			return nil, fmt.Errorf("preview frame of %d bytes is too short", len(raw))
+		}
+		format := binary.BigEndian.Uint32(body)
+		contentType, ok := imageFormats[format]
+		if !ok {
+			return nil, fmt.Errorf("unknown image format %d", format)
+		}
+		f.image = tracker.Image{Data: body[4:], ContentType: contentType}
+
+	case framePreviewImageWithMetadata:
+		if len(body) < 4 {
+			return nil, fmt.Errorf("preview frame of %d bytes is too short", len(raw))
+		}
+		size := binary.BigEndian.Uint32(body)
+		if uint64(size) > uint64(len(body)-4) {
+			return nil, fmt.Errorf("preview metadata of %d bytes exceeds the frame", size)
+		}
+		var metadata struct {
+			PromptID  string `json:"prompt_id"`
+			NodeID    string `json:"node_id"`
+			ImageType string `json:"image_type"`
+		}
+		if err := json.Unmarshal(body[4:4+size], &metadata); err != nil {
+			return nil, fmt.Errorf("failed to decode preview metadata: %w", err)
+		}
+		f.promptID, f.node = metadata.PromptID, metadata.NodeID
+		f.image = tracker.Image{Data: body[4+size:], ContentType: metadata.ImageType}
+	}
+
+	return f, nil
+}
@@ -0,0 +1,127 @@
+package comfy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// testFrame joins the big-endian header words and the rest of a binary frame.
+func testFrame(words []uint32, rest ...[]byte) []byte {
+	var buf bytes.Buffer
+	for _, word := range words {
+		binary.Write(&buf, binary.BigEndian, word)
+	}
+	for _, part := range rest {
+		buf.Write(part)
+	}
+	return buf.Bytes()
+}
+
+func TestParseFrame(t *testing.T) {
+	image := []byte("\x89PNG image")
+	metadata := []byte(`{"prompt_id": "p1", "node_id": "12", "image_type": "image/png"}`)
+
+	tests := []struct {
+		name            string
+		raw             []byte
+		wantType        uint32
+		wantContentType string
+		wantData        []byte
+		wantPromptID    string
+		wantNode        string
+		wantErr         string
+	}{
+		{
+			name:            "jpeg preview",
+			raw:             testFrame([]uint32{framePreviewImage, 1}, image),
+			wantType:        framePreviewImage,
+			wantContentType: "image/jpeg",
+			wantData:        image,
+		},
+		{
+			name:            "png preview",
+			raw:             testFrame([]uint32{framePreviewImage, 2}, image),
+			wantType:        framePreviewImage,
+			wantContentType: "image/png",
+			wantData:        image,
+		},
+		{
+			name:            "webp preview",
+			raw:             testFrame([]uint32{framePreviewImage, 3}, image),
+			wantType:        framePreviewImage,
+			wantContentType: "image/webp",
+			wantData:        image,
+		},
+		{
+			name:     "unencoded preview is not an image",
+			raw:      testFrame([]uint32{2}, image),
+			wantType: 2,
+		},
+		{
+			name:     "text",
+			raw:      testFrame([]uint32{frameText}, []byte("12"), []byte("sampling")),
+			wantType: frameText,
+		},
+		{
+			name:            "preview with metadata",
+			raw:             testFrame([]uint32{framePreviewImageWithMetadata, uint32(len(metadata))}, metadata, image),
+			wantType:        framePreviewImageWithMetadata,
+			wantContentType: "image/png",
+			wantData:        image,
+			wantPromptID:    "p1",
+			wantNode:        "12",
+		},
+		{
+			name:            "preview with metadata and no image",
+			raw:             testFrame([]uint32{framePreviewImageWithMetadata, uint32(len(metadata))}, metadata),
+			wantType:        framePreviewImageWithMetadata,
+			wantContentType: "image/png",
+			wantData:        []byte{},
+			wantPromptID:    "p1",
+			wantNode:        "12",
+		},
+		{name: "empty", raw: nil, wantErr: "too short"},
+		{name: "truncated event type", raw: []byte{0, 0, 1}, wantErr: "too short"},
+		{name: "truncated image format", raw: testFrame([]uint32{framePreviewImage}, []byte{0, 0}), wantErr: "too short"},
+		{name: "unknown image format", raw: testFrame([]uint32{framePreviewImage, 7}, image), wantErr: "unknown image format 7"},
+		{name: "truncated metadata length", raw: testFrame([]uint32{framePreviewImageWithMetadata}, []byte{0}), wantErr: "too short"},
+		{
+			name:    "metadata length beyond the frame",
+			raw:     testFrame([]uint32{framePreviewImageWithMetadata, uint32(len(metadata) + 1)}, metadata),
+			wantErr: "exceeds the frame",
+		},
+		{
+			name:    "huge metadata length",
+			raw:     testFrame([]uint32{framePreviewImageWithMetadata, 0xFFFFFFFF}, metadata),
+			wantErr: "exceeds the frame",
+		},
+		{
+			name:    "invalid metadata",
+			raw:     testFrame([]uint32{framePreviewImageWithMetadata, 3}, []byte("{no"), image),
+			wantErr: "failed to decode preview metadata",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := parseFrame(tt.raw)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseFrame() = %+v, %v, want error containing %q", f, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseFrame() = %v", err)
+			}
+			if f.eventType != tt.wantType || f.image.ContentType != tt.wantContentType || f.promptID != tt.wantPromptID || f.node != tt.wantNode {
+				t.Errorf("parseFrame() = type %d, %q, prompt %q, node %q, want type %d, %q, prompt %q, node %q",
+					f.eventType, f.image.ContentType, f.promptID, f.node, tt.wantType, tt.wantContentType, tt.wantPromptID, tt.wantNode)
+			}
+			if (f.image.Data == nil) != (tt.wantData == nil) || !bytes.Equal(f.image.Data, tt.wantData) {
+				t.Errorf("image data = %q, want %q", f.image.Data, tt.wantData)
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package comfy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/CP-Payne/comfylite/internal/tracker"
+	"github.com/CP-Payne/comfylite/internal/workflow"
+)
+
+// HistoryEntry is a single prompt as returned by ComfyUI's /history/{prompt_id}.
+type HistoryEntry struct {
+	Outputs map[string]json.RawMessage `json:"outputs"`
+	Status  struct {
+		StatusStr string `json:"status_str"`
+		Completed bool   `json:"completed"`
+		// Messages is a list of [event type, event data] pairs recorded during execution
+		Messages [][]json.RawMessage `json:"messages"`
+	} `json:"status"`
+	// Prompt is [number, prompt_id, prompt, extra_data, outputs_to_execute]
+	Prompt []json.RawMessage `json:"prompt"`
+}
+
+// streamsResults reports whether the prompt sends images over the websocket, like SaveImageWebsocket
+// does. ComfyUI keeps no copy of those, so they are lost if the prompt finished while disconnected.
+func (h *HistoryEntry) streamsResults() bool {
+	if len(h.Prompt) < 3 {
+		return false
+	}
+	nodes, err := workflow.StreamNodes(h.Prompt[2])
+	return err == nil && len(nodes) > 0
+}
+
+// executionError extracts the execution_error or execution_interrupted message recorded in the history.
+func (h *HistoryEntry) executionError() *tracker.ExecutionError {
+	for _, msg := range h.Status.Messages {
+		if len(msg) < 2 {
+			continue
+		}
+		var msgType string
+		var data map[string]interface{}
+		if json.Unmarshal(msg[0], &msgType) != nil || json.Unmarshal(msg[1], &data) != nil {
+			continue
+		}
+		switch msgType {
+		case "execution_error":
+			return executionErrorFrom(data)
+		case "execution_interrupted":
+			execErr := executionErrorFrom(data)
+			execErr.Interrupted = true
+			return execErr
+		}
+	}
+	return &tracker.ExecutionError{Message: "prompt failed in ComfyUI while disconnected"}
+}
+
+// queueResponse is ComfyUI's /queue. Each item is [number, prompt_id, prompt, extra_data, outputs_to_execute].
+type queueResponse struct {
+	Running [][]json.RawMessage `json:"queue_running"`
+	Pending [][]json.RawMessage `json:"queue_pending"`
+}
+
+// history returns the history entry for a prompt, or nil if ComfyUI does not know it.
+func (c *client) history(ctx context.Context, promptID string) (*HistoryEntry, error) {
+	var entries map[string]HistoryEntry
+	if err := c.getJSON(ctx, "/history/"+url.PathEscape(promptID), &entries); err != nil {
+		return nil, err
+	}
+
+	entry, ok := entries[promptID]
+	if !ok {
+		return nil, nil
+	}
+	return &entry, nil
+}
+
+// queuedPromptIDs returns the IDs of every prompt that is running or waiting in ComfyUI's queue.
+func (c *client) queuedPromptIDs(ctx context.Context) (map[string]bool, error) {
+	var queue queueResponse
+	if err := c.getJSON(ctx, "/queue", &queue); err != nil {
+		return nil, err
+	}
+
+	ids := make(map[string]bool)
+	for _, item := range append(queue.Running, queue.Pending...) {
+		if len(item) < 2 {
+			continue
+		}
+		var id string
+		if err := json.Unmarshal(item[1], &id); err == nil {
+			ids[id] = true
+		}
+	}
+	return ids, nil
+}
+
+func (c *client) getJSON(ctx context.Context, path string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+path, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request for %s: %w", path, err)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to request %s: %w", path, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("received non-200 status from ComfyUI for %s: %s", path, resp.Status)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode %s response: %w", path, err)
+	}
+	return nil
+}
+
+// resync reconciles in-flight prompts after connecting, which are the ones submitted before a
+// reconnect or adopted after a restart. Prompts that finished while the socket was down are
+// reported to the tracker from their history, prompts still queued are left alone and prompts
+// ComfyUI no longer knows about are failed. Finished prompts whose images were sent over the
+// websocket are failed as well, with ErrBackendLost so they are retried.
+func (c *client) resync(ctx context.Context, eventChan chan<- tracker.Event) {
+	c.inFlightMux.Lock()
+	promptIDs := make([]string, 0, len(c.inFlight))
+	for id := range c.inFlight {
+		promptIDs = append(promptIDs, id)
+	}
+	c.inFlightMux.Unlock()
+
+	if len(promptIDs) == 0 {
+		return
+	}
+
+	queued, err := c.queuedPromptIDs(ctx)
+	if err != nil {
+		log.Printf("Error: failed to resync in-flight prompts: %v", err)
+		return
+	}
+
+	for _, promptID := range promptIDs {
+		if queued[promptID] {
+			continue
+		}
+
+		entry, err := c.history(ctx, promptID)
+		if err != nil {
+			log.Printf("Error: failed to fetch history for prompt %s: %v", promptID, err)
+			continue
+		}
+
+		c.untrack(promptID)
+
+		switch {
+		case entry == nil:
+			log.Printf("Prompt %s vanished from ComfyUI while disconnected", promptID)
+			eventChan <- tracker.Event{Type: tracker.EventJobFailed, PromptID: promptID, Data: fmt.Errorf("%w: prompt is no longer known to ComfyUI", tracker.ErrBackendLost)}
+		case entry.Status.StatusStr == "error":
+			eventChan <- tracker.Event{Type: tracker.EventJobFailed, PromptID: promptID, Data: entry.executionError()}
+		case entry.streamsResults():
+			// The images went out over the old socket, running the prompt again is the only way to get them
+			log.Printf("Prompt %s finished while disconnected, its websocket images are lost", promptID)
+			eventChan <- tracker.Event{Type: tracker.EventJobFailed, PromptID: promptID, Data: fmt.Errorf("%w: prompt finished while disconnected and its images were sent over the websocket", tracker.ErrBackendLost)}
+		default:
+			// Files saved by the workflow can still be fetched
+			c.sendHistoryOutputs(ctx, eventChan, promptID, entry, nil)
+			eventChan <- tracker.Event{Type: tracker.EventExecutionFinished, PromptID: promptID}
+		}
+	}
+}
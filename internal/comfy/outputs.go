@@ -0,0 +1,119 @@
+package comfy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/CP-Payne/comfylite/internal/tracker"
+)
+
+// outputImage is a file a node such as SaveImage or PreviewImage wrote, as listed in the output of
+// an executed event or a history entry.
+type outputImage struct {
+	Filename  string `json:"filename"`
+	Subfolder string `json:"subfolder"`
+	// Type is the ComfyUI directory the file is in: "output", "temp" or "input"
+	Type string `json:"type"`
+}
+
+// nodeOutput is the output a node reports once it has executed.
+type nodeOutput struct {
+	Images []outputImage `json:"images"`
+}
+
+// outputImagesFrom reads the images of a node output decoded from an executed event.
+func outputImagesFrom(output interface{}) []outputImage {
+	raw, err := json.Marshal(output)
+	if err != nil {
+		return nil
+	}
+	var out nodeOutput
+	if err := json.Unmarshal(raw, &out); err != nil {
+		return nil
+	}
+	return out.Images
+}
+
+// sendOutputs downloads a node's output images through /view and reports them to the tracker in
+// order. A failed download fails the prompt, as its result would be incomplete.
+func (c *client) sendOutputs(ctx context.Context, eventChan chan<- tracker.Event, promptID, node string, images []outputImage) {
+	for _, image := range images {
+		data, contentType, err := c.view(ctx, image)
+		if err != nil {
+			eventChan <- tracker.Event{Type: tracker.EventJobFailed, PromptID: promptID, Node: node, Data: fmt.Errorf("failed to download image %q of node %s: %w", image.Filename, node, err)}
+			return
+		}
+		eventChan <- tracker.Event{Type: tracker.EventImageReceived, PromptID: promptID, Node: node, Data: tracker.OutputImage{
+			Image:     tracker.Image{Data: data, ContentType: contentType},
+			Temporary: image.Type == "temp",
+		}}
+	}
+}
+
+// sendHistoryOutputs reports the output images recorded in a prompt's history, for prompts that
+// finished while the websocket was down. If only is given, just the outputs of those nodes are sent.
+func (c *client) sendHistoryOutputs(ctx context.Context, eventChan chan<- tracker.Event, promptID string, entry *HistoryEntry, only []string) {
+	nodes := make([]string, 0, len(entry.Outputs))
+	for node := range entry.Outputs {
+		if only == nil || slices.Contains(only, node) {
+			nodes = append(nodes, node)
+		}
+	}
+	slices.Sort(nodes)
+
+	for _, node := range nodes {
+		var out nodeOutput
+		if err := json.Unmarshal(entry.Outputs[node], &out); err != nil {
+			continue
+		}
+		c.sendOutputs(ctx, eventChan, promptID, node, out.Images)
+	}
+}
+
+// sendCachedOutputs reports the outputs of nodes ComfyUI served from its cache without an executed
+// event, as older versions do. Their files are still listed in the prompt's history.
+func (c *client) sendCachedOutputs(ctx context.Context, eventChan chan<- tracker.Event, promptID string, nodes []string) {
+	entry, err := c.history(ctx, promptID)
+	if err != nil || entry == nil {
+		log.Printf("Error: failed to fetch the cached outputs of prompt %s: %v", promptID, err)
+		return
+	}
+	c.sendHistoryOutputs(ctx, eventChan, promptID, entry, nodes)
+}
+
+// view downloads a file from ComfyUI and returns it with its MIME type.
+func (c *client) view(ctx context.Context, image outputImage) ([]byte, string, error) {
+	query := url.Values{"filename": {image.Filename}, "subfolder": {image.Subfolder}, "type": {image.Type}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/view?"+query.Encode(), nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create request for /view: %w", err)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to request /view: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("received non-200 status from ComfyUI for /view: %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read /view response: %w", err)
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	if !strings.HasPrefix(contentType, "image/") {
+		contentType = http.DetectContentType(data)
+	}
+	return data, contentType, nil
+}
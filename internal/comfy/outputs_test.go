@@ -0,0 +1,49 @@
+package comfy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/CP-Payne/comfylite/internal/tracker"
+)
+
+func TestSendCachedOutputs(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/history/prompt-1":
+			w.Write([]byte(`{"prompt-1": {"outputs": {
+				"9": {"images": [{"filename": "cat_00001_.png", "subfolder": "", "type": "output"}]},
+				"12": {"images": [{"filename": "preview.png", "subfolder": "", "type": "temp"}]}
+			}}}`))
+		case "/view":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte(r.URL.Query().Get("filename")))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	c := newClient(server.URL, "test", nil)
+	events := make(chan tracker.Event, 10)
+	// 4 is a cached loader, which has no output in the history
+	c.sendCachedOutputs(context.Background(), events, "prompt-1", []string{"4", "9"})
+	close(events)
+
+	var got []tracker.Event
+	for event := range events {
+		got = append(got, event)
+	}
+	if len(got) != 1 {
+		t.Fatalf("got %d events, want the image of node 9 only: %+v", len(got), got)
+	}
+	image, ok := got[0].Data.(tracker.OutputImage)
+	if got[0].Type != tracker.EventImageReceived || got[0].Node != "9" || !ok {
+		t.Fatalf("event = %+v, want an output image of node 9", got[0])
+	}
+	if string(image.Data) != "cat_00001_.png" || image.ContentType != "image/png" || image.Temporary {
+		t.Errorf("image = %q %s temporary=%t, want cat_00001_.png as a saved PNG", image.Data, image.ContentType, image.Temporary)
+	}
+}
@@ -0,0 +1,352 @@
+package comfy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/CP-Payne/comfylite/internal/tracker"
+)
+
+// ErrNoBackend is returned when no ComfyUI instance can take a prompt.
+var ErrNoBackend = errors.New("no ComfyUI backend available")
+
+// healthCheckTimeout bounds a single backend's health check
+const healthCheckTimeout = 5 * time.Second
+
+// BackendConfig describes one ComfyUI instance of the pool.
+type BackendConfig struct {
+	Address string
+	// Tags name the capabilities of the instance, such as the model weights it has.
+	Tags []string
+}
+
+// backendLoad is what the last health check saw of a backend.
+type backendLoad struct {
+	// queueDepth is the number of running and pending prompts in ComfyUI's queue
+	queueDepth int
+	// submitted counts prompts sent since the last check, which queueDepth does not include yet
+	submitted int
+	// vramFree is the free VRAM in bytes summed over all devices
+	vramFree int64
+}
+
+type pool struct {
+	backends       []*client
+	healthInterval time.Duration
+}
+
+// NewPool returns a Client that spreads prompts over several ComfyUI instances. Each instance gets
+// its own websocket. Prompts go to the healthy instance with the shortest queue, preferring the one
+// with the most free VRAM, and instances that fail their health check are skipped until they pass
+// again.
+func NewPool(backends []BackendConfig, clientID string, healthInterval time.Duration) Client {
+	p := &pool{healthInterval: healthInterval}
+	for _, backend := range backends {
+		p.backends = append(p.backends, newClient(backend.Address, clientID, backend.Tags))
+	}
+	return p
+}
+
+// Start connects to every backend. It fails only if none can be reached; the others keep
+// retrying in the background and join the pool once they are up.
+func (p *pool) Start(ctx context.Context, eventChan chan<- tracker.Event) error {
+	started := make([]bool, len(p.backends))
+	anyStarted := false
+
+	var err error
+	for attempt := 0; attempt < startAttempts && !anyStarted; attempt++ {
+		if attempt > 0 {
+			if !sleepCtx(ctx, backoff(attempt-1)) {
+				return ctx.Err()
+			}
+		}
+		for i, backend := range p.backends {
+			if started[i] {
+				continue
+			}
+			if err = backend.connect(); err != nil {
+				log.Printf("Failed to connect to ComfyUI websocket at %s (attempt %d/%d): %v", backend.baseURL, attempt+1, startAttempts, err)
+				continue
+			}
+			started[i], anyStarted = true, true
+			go backend.run(ctx, eventChan, true)
+		}
+	}
+	if !anyStarted {
+		return fmt.Errorf("failed to connect to ComfyUI after %d attempts: %w", startAttempts, err)
+	}
+
+	for i, backend := range p.backends {
+		if !started[i] {
+			go backend.run(ctx, eventChan, false)
+		}
+	}
+	go p.monitor(ctx)
+
+	return nil
+}
+
+func (p *pool) Submit(promptID string, workflow []byte, opts SubmitOptions) (string, error) {
+	backend := p.pick(opts.Requires, opts.Avoid)
+	if backend == nil {
+		backend = p.pick(opts.Requires, nil)
+	}
+	if backend == nil {
+		return "", fmt.Errorf("%w with tags %v", ErrNoBackend, opts.Requires)
+	}
+
+	// A retried prompt keeps its ID, make sure only the new backend reports on it
+	for _, other := range p.backends {
+		if other != backend {
+			other.untrack(promptID)
+		}
+	}
+
+	if err := backend.submit(promptID, workflow); err != nil {
+		return backend.baseURL, fmt.Errorf("%s: %w", backend.baseURL, err)
+	}
+
+	backend.stateMux.Lock()
+	backend.load.submitted++
+	backend.stateMux.Unlock()
+	return backend.baseURL, nil
+}
+
+func (p *pool) Adopt(promptID, backend string) bool {
+	for _, c := range p.backends {
+		if c.baseURL == backend {
+			c.inFlightMux.Lock()
+			c.inFlight[promptID] = time.Now()
+			c.inFlightMux.Unlock()
+			return true
+		}
+	}
+	return false
+}
+
+// pick returns the least loaded healthy backend that has all required tags and is not in avoid.
+func (p *pool) pick(requires, avoid []string) *client {
+	var best *client
+	var bestLoad backendLoad
+	for _, backend := range p.backends {
+		if !backend.hasTags(requires) || slices.Contains(avoid, backend.baseURL) {
+			continue
+		}
+		load, healthy := backend.state()
+		if !healthy {
+			continue
+		}
+		if best == nil || load.less(bestLoad) {
+			best, bestLoad = backend, load
+		}
+	}
+	return best
+}
+
+func (p *pool) CanRun(requires []string) bool {
+	for _, backend := range p.backends {
+		if backend.hasTags(requires) {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the workflow against the healthy backends that have the required tags, or all
+// of them with the tags if none is healthy. The workflow is valid if any backend could run it, and
+// it is let through unchecked if no backend's /object_info can be read.
+func (p *pool) Validate(ctx context.Context, workflow []byte, requires []string) error {
+	candidates := p.candidates(requires)
+
+	// Stays nil if no backend could be checked
+	var validationErr error
+	for _, backend := range candidates {
+		err := backend.validate(ctx, workflow)
+		var promptErr *PromptValidationError
+		switch {
+		case err == nil:
+			return nil
+		case errors.As(err, &promptErr):
+			if validationErr == nil {
+				validationErr = err
+			}
+		default:
+			log.Printf("Skipping validation against ComfyUI backend %s: %v", backend.baseURL, err)
+		}
+	}
+	return validationErr
+}
+
+// candidates returns the healthy backends that have the required tags, or all of them with the
+// tags if none is healthy.
+func (p *pool) candidates(requires []string) []*client {
+	var healthy, all []*client
+	for _, backend := range p.backends {
+		if !backend.hasTags(requires) {
+			continue
+		}
+		all = append(all, backend)
+		if _, ok := backend.state(); ok {
+			healthy = append(healthy, backend)
+		}
+	}
+	if len(healthy) == 0 {
+		return all
+	}
+	return healthy
+}
+
+// Dequeue removes prompts from the queues of the backends they were sent to. Unknown prompts are ignored.
+func (p *pool) Dequeue(ctx context.Context, promptIDs ...string) error {
+	for _, backend := range p.backends {
+		var owned []string
+		for _, id := range promptIDs {
+			if backend.owns(id) {
+				owned = append(owned, id)
+			}
+		}
+		if len(owned) == 0 {
+			continue
+		}
+		if err := backend.Dequeue(ctx, owned...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *pool) Interrupt(ctx context.Context, promptID string) error {
+	for _, backend := range p.backends {
+		if backend.owns(promptID) {
+			return backend.Interrupt(ctx, promptID)
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrPromptNotOwned, promptID)
+}
+
+// Abandon stops the prompt on the backends that own it, the others ignore it.
+func (p *pool) Abandon(ctx context.Context, promptID string) error {
+	var errs []error
+	for _, backend := range p.backends {
+		if err := backend.Abandon(ctx, promptID); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", backend.baseURL, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// monitor checks every backend's health and load until ctx is cancelled.
+func (p *pool) monitor(ctx context.Context) {
+	ticker := time.NewTicker(p.healthInterval)
+	defer ticker.Stop()
+
+	for {
+		var wg sync.WaitGroup
+		for _, backend := range p.backends {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				backend.checkHealth(ctx)
+			}()
+		}
+		wg.Wait()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (l backendLoad) less(other backendLoad) bool {
+	depth, otherDepth := l.queueDepth+l.submitted, other.queueDepth+other.submitted
+	if depth != otherDepth {
+		return depth < otherDepth
+	}
+	return l.vramFree > other.vramFree
+}
+
+func (c *client) hasTags(requires []string) bool {
+	for _, tag := range requires {
+		if !slices.Contains(c.tags, tag) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *client) owns(promptID string) bool {
+	c.inFlightMux.Lock()
+	defer c.inFlightMux.Unlock()
+
+	_, ok := c.inFlight[promptID]
+	return ok
+}
+
+func (c *client) setConnected(connected bool) {
+	c.stateMux.Lock()
+	defer c.stateMux.Unlock()
+
+	c.connected = connected
+}
+
+// state returns the backend's last known load and whether it can take prompts.
+func (c *client) state() (backendLoad, bool) {
+	c.stateMux.Lock()
+	defer c.stateMux.Unlock()
+
+	return c.load, c.connected && c.checkErr == nil
+}
+
+// systemStats is the part of ComfyUI's /system_stats used for load balancing.
+type systemStats struct {
+	Devices []struct {
+		Name     string `json:"name"`
+		VRAMFree int64  `json:"vram_free"`
+	} `json:"devices"`
+}
+
+// checkHealth refreshes the backend's load. A backend is healthy when its websocket is connected
+// and /queue answers; /system_stats is optional as it only refines the choice between backends.
+func (c *client) checkHealth(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	var queue queueResponse
+	queueErr := c.getJSON(ctx, "/queue", &queue)
+
+	var stats systemStats
+	var vramFree int64
+	if err := c.getJSON(ctx, "/system_stats", &stats); err == nil {
+		for _, device := range stats.Devices {
+			vramFree += device.VRAMFree
+		}
+	}
+
+	c.stateMux.Lock()
+	defer c.stateMux.Unlock()
+
+	wasHealthy := c.connected && c.checkErr == nil
+	c.checkErr = queueErr
+	if queueErr == nil {
+		c.load = backendLoad{queueDepth: len(queue.Running) + len(queue.Pending), vramFree: vramFree}
+	}
+	healthy := c.connected && c.checkErr == nil
+
+	switch {
+	case wasHealthy && !healthy:
+		reason := "websocket disconnected"
+		if queueErr != nil {
+			reason = queueErr.Error()
+		}
+		log.Printf("Removing ComfyUI backend %s from the pool: %s", c.baseURL, reason)
+	case !wasHealthy && healthy:
+		log.Printf("ComfyUI backend %s is healthy, adding it to the pool.", c.baseURL)
+	}
+}
@@ -0,0 +1,111 @@
+package comfy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	// abandonTimeout bounds how long Abandon waits for an interrupted prompt to leave the queue
+	abandonTimeout = 30 * time.Second
+	// abandonPollInterval is how often Abandon checks the queue meanwhile
+	abandonPollInterval = 500 * time.Millisecond
+)
+
+// Dequeue removes prompts that have not started yet from ComfyUI's queue.
+// Prompts that are not pending are ignored by ComfyUI. Only prompts that are confirmed gone from
+// the queue stop being tracked, a prompt that already started stays owned so it can be interrupted.
+func (c *client) Dequeue(ctx context.Context, promptIDs ...string) error {
+	if err := c.postJSON(ctx, "/queue", map[string][]string{"delete": promptIDs}); err != nil {
+		return fmt.Errorf("failed to dequeue prompts: %w", err)
+	}
+
+	queued, err := c.queuedPromptIDs(ctx)
+	if err != nil {
+		// Keep ownership, the terminal event or the next resync untracks the prompts
+		log.Printf("Failed to confirm dequeued prompts on %s: %v", c.baseURL, err)
+		return nil
+	}
+	for _, id := range promptIDs {
+		if !queued[id] {
+			c.untrack(id)
+		}
+	}
+	return nil
+}
+
+// Interrupt stops the prompt ComfyUI is currently executing. The prompt ID is passed along so
+// ComfyUI versions that support it only interrupt that prompt and leave others alone.
+func (c *client) Interrupt(ctx context.Context, promptID string) error {
+	if err := c.postJSON(ctx, "/interrupt", map[string]string{"prompt_id": promptID}); err != nil {
+		return fmt.Errorf("failed to interrupt prompt %s: %w", promptID, err)
+	}
+	return nil
+}
+
+// Abandon removes the prompt from ComfyUI's queue, or interrupts it if it already runs, and waits
+// until the queue no longer lists it. The prompt is untracked either way so its late events are
+// not mistaken for those of a new attempt.
+func (c *client) Abandon(ctx context.Context, promptID string) error {
+	if !c.owns(promptID) {
+		return nil
+	}
+	defer c.untrack(promptID)
+
+	ctx, cancel := context.WithTimeout(ctx, abandonTimeout)
+	defer cancel()
+
+	if err := c.postJSON(ctx, "/queue", map[string][]string{"delete": {promptID}}); err != nil {
+		return fmt.Errorf("failed to dequeue prompt %s: %w", promptID, err)
+	}
+
+	interrupted := false
+	for {
+		queued, err := c.queuedPromptIDs(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to confirm prompt %s stopped: %w", promptID, err)
+		}
+		if !queued[promptID] {
+			return nil
+		}
+		// Still listed after the delete, so it is the running prompt
+		if !interrupted {
+			if err := c.Interrupt(ctx, promptID); err != nil {
+				return err
+			}
+			interrupted = true
+		}
+		if !sleepCtx(ctx, abandonPollInterval) {
+			return fmt.Errorf("prompt %s is still running on %s: %w", promptID, c.baseURL, ctx.Err())
+		}
+	}
+}
+
+func (c *client) postJSON(ctx context.Context, path string, body any) error {
+	reqBody, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request for %s: %w", path, err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+path, bytes.NewReader(reqBody))
+	if err != nil {
+		return fmt.Errorf("failed to create request for %s: %w", path, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to request %s: %w", path, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("received non-200 status from ComfyUI for %s: %s", path, resp.Status)
+	}
+	return nil
+}
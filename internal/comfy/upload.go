@@ -0,0 +1,119 @@
+package comfy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// uploadSubfolder is the folder in ComfyUI's input directory that uploads are written to
+const uploadSubfolder = "comfylite"
+
+// Upload is an input image for LoadImage and similar nodes.
+type Upload struct {
+	Data []byte
+	// Name is the file name to store the image under. It should be unique, as files are overwritten.
+	Name string
+	// MaskOf is the uploaded image a mask applies to, as returned by UploadImage. The mask's alpha
+	// channel is merged into a copy of that image, which LoadImage then outputs as its mask.
+	MaskOf string
+}
+
+// uploadResponse is ComfyUI's answer to /upload/image and /upload/mask.
+type uploadResponse struct {
+	Name      string `json:"name"`
+	Subfolder string `json:"subfolder"`
+	Type      string `json:"type"`
+}
+
+// UploadImage uploads an image to every backend that may run a workflow with the required tags, so
+// the prompt finds it wherever it is sent. It returns the name to put into the workflow.
+func (p *pool) UploadImage(ctx context.Context, upload Upload, requires []string) (string, error) {
+	var name string
+	var err error
+	for _, backend := range p.candidates(requires) {
+		uploaded, uploadErr := backend.upload(ctx, upload)
+		if uploadErr != nil {
+			log.Printf("Failed to upload %s to ComfyUI backend %s: %v", upload.Name, backend.baseURL, uploadErr)
+			err = uploadErr
+			continue
+		}
+		name = uploaded
+	}
+	if name == "" {
+		if err == nil {
+			err = fmt.Errorf("%w with tags %v", ErrNoBackend, requires)
+		}
+		return "", fmt.Errorf("failed to upload image %s: %w", upload.Name, err)
+	}
+	return name, nil
+}
+
+func (c *client) upload(ctx context.Context, upload Upload) (string, error) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+
+	part, err := mw.CreateFormFile("image", upload.Name)
+	if err != nil {
+		return "", fmt.Errorf("failed to create upload form: %w", err)
+	}
+	if _, err := part.Write(upload.Data); err != nil {
+		return "", fmt.Errorf("failed to create upload form: %w", err)
+	}
+	fields := map[string]string{"overwrite": "true", "subfolder": uploadSubfolder, "type": "input"}
+
+	endpoint := "/upload/image"
+	if upload.MaskOf != "" {
+		endpoint = "/upload/mask"
+		subfolder, filename := path.Split(upload.MaskOf)
+		ref, err := json.Marshal(map[string]string{"filename": filename, "subfolder": strings.TrimSuffix(subfolder, "/"), "type": "input"})
+		if err != nil {
+			return "", fmt.Errorf("failed to marshal original_ref: %w", err)
+		}
+		fields["original_ref"] = string(ref)
+	}
+	for key, value := range fields {
+		if err := mw.WriteField(key, value); err != nil {
+			return "", fmt.Errorf("failed to create upload form: %w", err)
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return "", fmt.Errorf("failed to create upload form: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+endpoint, &body)
+	if err != nil {
+		return "", fmt.Errorf("failed to create request for %s: %w", endpoint, err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to request %s: %w", endpoint, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+		return "", fmt.Errorf("received non-200 status from ComfyUI for %s: %s: %s", endpoint, resp.Status, bytes.TrimSpace(msg))
+	}
+
+	var uploaded uploadResponse
+	if err := json.NewDecoder(resp.Body).Decode(&uploaded); err != nil {
+		return "", fmt.Errorf("failed to decode %s response: %w", endpoint, err)
+	}
+
+	name := uploaded.Name
+	if uploaded.Subfolder != "" {
+		name = uploaded.Subfolder + "/" + uploaded.Name
+	}
+	c.objectInfoCache.addUpload(name)
+	return name, nil
+}
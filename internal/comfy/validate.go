@@ -0,0 +1,273 @@
+package comfy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// objectInfoTTL is how long a backend's /object_info is cached. Custom nodes and models added to
+// ComfyUI are picked up once it expires.
+const objectInfoTTL = 5 * time.Minute
+
+// NodeError is a problem with one input of a workflow node.
+type NodeError struct {
+	NodeID    string `json:"node_id"`
+	ClassType string `json:"class_type,omitempty"`
+	Input     string `json:"input,omitempty"`
+	Message   string `json:"message"`
+}
+
+// PromptValidationError is returned when a workflow does not fit the nodes ComfyUI offers, either
+// found by Validate or reported by ComfyUI in the node_errors of a rejected prompt.
+type PromptValidationError struct {
+	Errors []NodeError
+}
+
+func (e *PromptValidationError) Error() string {
+	msgs := make([]string, 0, len(e.Errors))
+	for _, nodeErr := range e.Errors {
+		msg := fmt.Sprintf("node %s", nodeErr.NodeID)
+		if nodeErr.ClassType != "" {
+			msg += fmt.Sprintf(" (%s)", nodeErr.ClassType)
+		}
+		if nodeErr.Input != "" {
+			msg += " input " + nodeErr.Input
+		}
+		msgs = append(msgs, msg+": "+nodeErr.Message)
+	}
+	return "invalid workflow: " + strings.Join(msgs, "; ")
+}
+
+// Unwrap makes validation errors match ErrPromptRejected, so they are never retried.
+func (e *PromptValidationError) Unwrap() error {
+	return ErrPromptRejected
+}
+
+func (e *PromptValidationError) add(nodeID, classType, input, format string, args ...any) {
+	e.Errors = append(e.Errors, NodeError{NodeID: nodeID, ClassType: classType, Input: input, Message: fmt.Sprintf(format, args...)})
+}
+
+// nodeInfo is the part of a node class in /object_info used for validation.
+type nodeInfo struct {
+	Input struct {
+		Required map[string]inputSpec `json:"required"`
+		Optional map[string]inputSpec `json:"optional"`
+	} `json:"input"`
+}
+
+// inputSpec describes an input as ComfyUI does: either [type, options] or [[choices...], options].
+// Newer ComfyUI versions also describe choices as ["COMBO", {"options": [...]}].
+type inputSpec struct {
+	Type    string
+	Choices []any
+	Min     *float64
+	Max     *float64
+}
+
+func (s *inputSpec) UnmarshalJSON(data []byte) error {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil || len(raw) == 0 {
+		// Unknown shapes are accepted without constraints
+		return nil
+	}
+
+	var opts struct {
+		Min     *float64 `json:"min"`
+		Max     *float64 `json:"max"`
+		Options []any    `json:"options"`
+	}
+	if len(raw) > 1 {
+		// Options of some inputs are not an object, they are ignored as well
+		_ = json.Unmarshal(raw[1], &opts)
+	}
+	s.Min, s.Max = opts.Min, opts.Max
+
+	if err := json.Unmarshal(raw[0], &s.Choices); err == nil {
+		s.Type = "COMBO"
+		return nil
+	}
+	if err := json.Unmarshal(raw[0], &s.Type); err != nil {
+		return nil
+	}
+	if s.Type == "COMBO" {
+		s.Choices = opts.Options
+	}
+	return nil
+}
+
+// workflowNode is a node of a workflow in ComfyUI's API format.
+type workflowNode struct {
+	ClassType string         `json:"class_type"`
+	Inputs    map[string]any `json:"inputs"`
+}
+
+// objectInfoCache holds a backend's /object_info.
+type objectInfoCache struct {
+	mux       sync.Mutex
+	nodes     map[string]nodeInfo
+	fetchedAt time.Time
+	// uploads are images uploaded since nodes was fetched, which its LoadImage choices lack
+	uploads map[string]bool
+}
+
+func (oc *objectInfoCache) addUpload(name string) {
+	oc.mux.Lock()
+	defer oc.mux.Unlock()
+
+	if oc.uploads == nil {
+		oc.uploads = make(map[string]bool)
+	}
+	oc.uploads[name] = true
+}
+
+// objectInfo returns the backend's node classes and the images uploaded since they were fetched,
+// fetching them if the cache is empty or stale.
+func (c *client) objectInfo(ctx context.Context) (map[string]nodeInfo, map[string]bool, error) {
+	oc := &c.objectInfoCache
+	oc.mux.Lock()
+	defer oc.mux.Unlock()
+
+	if oc.nodes != nil && time.Since(oc.fetchedAt) < objectInfoTTL {
+		return oc.nodes, maps.Clone(oc.uploads), nil
+	}
+
+	var nodes map[string]nodeInfo
+	if err := c.getJSON(ctx, "/object_info", &nodes); err != nil {
+		return nil, nil, err
+	}
+	oc.nodes, oc.fetchedAt, oc.uploads = nodes, time.Now(), nil
+	return nodes, nil, nil
+}
+
+// validate checks a workflow against the backend's node classes.
+func (c *client) validate(ctx context.Context, workflow []byte) error {
+	nodes, uploads, err := c.objectInfo(ctx)
+	if err != nil {
+		return err
+	}
+
+	var prompt map[string]workflowNode
+	if err := json.Unmarshal(workflow, &prompt); err != nil {
+		return fmt.Errorf("failed to decode workflow: %w", err)
+	}
+	return validateWorkflow(prompt, nodes, uploads)
+}
+
+// validateWorkflow checks every node of the prompt. uploads are accepted as choices on top of the
+// ones in nodes.
+func validateWorkflow(prompt map[string]workflowNode, nodes map[string]nodeInfo, uploads map[string]bool) error {
+	validationErr := &PromptValidationError{}
+
+	// Keys are visited in order so the errors come out in a stable order
+	for _, id := range sortedKeys(prompt) {
+		node := prompt[id]
+		info, ok := nodes[node.ClassType]
+		if !ok {
+			validationErr.add(id, node.ClassType, "", "node class %q is not installed in ComfyUI", node.ClassType)
+			continue
+		}
+
+		for _, name := range sortedKeys(info.Input.Required) {
+			value, ok := node.Inputs[name]
+			if !ok {
+				validationErr.add(id, node.ClassType, name, "required input is missing")
+				continue
+			}
+			checkInput(validationErr, id, node.ClassType, name, value, info.Input.Required[name], uploads)
+		}
+		for _, name := range sortedKeys(info.Input.Optional) {
+			if value, ok := node.Inputs[name]; ok {
+				checkInput(validationErr, id, node.ClassType, name, value, info.Input.Optional[name], uploads)
+			}
+		}
+	}
+
+	if len(validationErr.Errors) > 0 {
+		return validationErr
+	}
+	return nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	return slices.Sorted(maps.Keys(m))
+}
+
+// checkInput validates a literal input value. Links to other nodes' outputs are not checked.
+func checkInput(validationErr *PromptValidationError, nodeID, classType, name string, value any, spec inputSpec, uploads map[string]bool) {
+	if link, ok := value.([]any); ok && len(link) == 2 {
+		return
+	}
+
+	switch spec.Type {
+	case "COMBO":
+		if s, ok := value.(string); ok && uploads[s] {
+			return
+		}
+		if len(spec.Choices) > 0 && !slices.Contains(spec.Choices, value) {
+			validationErr.add(nodeID, classType, name, "%v is not one of the available values %v", value, spec.Choices)
+		}
+	case "INT", "FLOAT":
+		n, ok := value.(float64)
+		if !ok {
+			validationErr.add(nodeID, classType, name, "must be a number, got %v", value)
+			return
+		}
+		if spec.Type == "INT" && n != math.Trunc(n) {
+			validationErr.add(nodeID, classType, name, "must be an integer, got %v", n)
+		}
+		if spec.Min != nil && n < *spec.Min {
+			validationErr.add(nodeID, classType, name, "%v is less than the minimum of %v", n, *spec.Min)
+		}
+		if spec.Max != nil && n > *spec.Max {
+			validationErr.add(nodeID, classType, name, "%v is greater than the maximum of %v", n, *spec.Max)
+		}
+	case "BOOLEAN":
+		if _, ok := value.(bool); !ok {
+			validationErr.add(nodeID, classType, name, "must be a boolean, got %v", value)
+		}
+	case "STRING":
+		if _, ok := value.(string); !ok {
+			validationErr.add(nodeID, classType, name, "must be a string, got %v", value)
+		}
+	}
+}
+
+// comfyNodeErrors is the node_errors object of a rejected /prompt request.
+type comfyNodeErrors map[string]struct {
+	ClassType string `json:"class_type"`
+	Errors    []struct {
+		Type      string `json:"type"`
+		Message   string `json:"message"`
+		Details   string `json:"details"`
+		ExtraInfo struct {
+			InputName string `json:"input_name"`
+		} `json:"extra_info"`
+	} `json:"errors"`
+}
+
+// promptErrorFrom turns ComfyUI's answer to a rejected prompt into a PromptValidationError. It
+// returns nil if the answer names no node errors.
+func promptErrorFrom(nodeErrors comfyNodeErrors) *PromptValidationError {
+	validationErr := &PromptValidationError{}
+	for _, id := range sortedKeys(nodeErrors) {
+		node := nodeErrors[id]
+		for _, e := range node.Errors {
+			msg := e.Message
+			if e.Details != "" {
+				msg += ": " + e.Details
+			}
+			validationErr.add(id, node.ClassType, e.ExtraInfo.InputName, "%s", msg)
+		}
+	}
+	if len(validationErr.Errors) == 0 {
+		return nil
+	}
+	return validationErr
+}
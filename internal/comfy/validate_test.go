@@ -0,0 +1,177 @@
+package comfy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// testObjectInfo is a trimmed /object_info with both ways ComfyUI describes choices.
+const testObjectInfo = `{
+	"KSampler": {"input": {
+		"required": {
+			"model": ["MODEL"],
+			"seed": ["INT", {"default": 0, "min": 0, "max": 18446744073709551615}],
+			"steps": ["INT", {"default": 20, "min": 1, "max": 10000}],
+			"cfg": ["FLOAT", {"default": 8.0, "min": 0.0, "max": 100.0, "step": 0.1}],
+			"sampler_name": [["euler", "dpmpp_2m"]],
+			"denoise": ["FLOAT", {"default": 1.0, "min": 0.0, "max": 1.0}]
+		}
+	}},
+	"LoadImage": {"input": {
+		"required": {"image": ["COMBO", {"options": ["example.png"], "image_upload": true}]},
+		"optional": {"upload": ["IMAGEUPLOAD"]}
+	}},
+	"CLIPTextEncode": {"input": {
+		"required": {"text": ["STRING", {"multiline": true}], "clip": ["CLIP"]}
+	}},
+	"VAEDecode": {"input": {
+		"required": {"samples": ["LATENT"], "vae": ["VAE"]},
+		"optional": {"tiled": ["BOOLEAN", {"default": false}]}
+	}}
+}`
+
+func TestValidate(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/object_info" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(testObjectInfo))
+	}))
+	defer server.Close()
+
+	c := newClient(server.URL, "test", nil)
+	// Fetch /object_info before the upload, as Validate would have
+	if _, _, err := c.objectInfo(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	c.objectInfoCache.addUpload("uploaded-cat.png")
+
+	const sampler = `"model": ["4", 0], "seed": 12345678901234567890, "steps": 20, "cfg": 7.5, "sampler_name": "euler", "denoise": 1`
+
+	tests := []struct {
+		name     string
+		workflow string
+		want     []NodeError
+	}{
+		{
+			name: "valid",
+			workflow: `{
+				"3": {"class_type": "KSampler", "inputs": {` + sampler + `}},
+				"6": {"class_type": "CLIPTextEncode", "inputs": {"text": "a cat", "clip": ["4", 1]}},
+				"8": {"class_type": "VAEDecode", "inputs": {"samples": ["3", 0], "vae": ["4", 2], "tiled": true}}
+			}`,
+		},
+		{
+			name:     "unknown class type",
+			workflow: `{"3": {"class_type": "UpscaleModelLoader", "inputs": {}}}`,
+			want: []NodeError{
+				{NodeID: "3", ClassType: "UpscaleModelLoader", Message: `node class "UpscaleModelLoader" is not installed in ComfyUI`},
+			},
+		},
+		{
+			name:     "missing required input",
+			workflow: `{"6": {"class_type": "CLIPTextEncode", "inputs": {"clip": ["4", 1]}}}`,
+			want:     []NodeError{{NodeID: "6", ClassType: "CLIPTextEncode", Input: "text", Message: "required input is missing"}},
+		},
+		{
+			name: "int and float out of range",
+			workflow: `{"3": {"class_type": "KSampler", "inputs": {
+				"model": ["4", 0], "seed": -1, "steps": 20.5, "cfg": 101, "sampler_name": "euler", "denoise": 1
+			}}}`,
+			want: []NodeError{
+				{NodeID: "3", ClassType: "KSampler", Input: "cfg", Message: "101 is greater than the maximum of 100"},
+				{NodeID: "3", ClassType: "KSampler", Input: "seed", Message: "-1 is less than the minimum of 0"},
+				{NodeID: "3", ClassType: "KSampler", Input: "steps", Message: "must be an integer, got 20.5"},
+			},
+		},
+		{
+			name: "wrong types",
+			workflow: `{
+				"6": {"class_type": "CLIPTextEncode", "inputs": {"text": 5, "clip": ["4", 1]}},
+				"8": {"class_type": "VAEDecode", "inputs": {"samples": ["3", 0], "vae": ["4", 2], "tiled": "yes"}}
+			}`,
+			want: []NodeError{
+				{NodeID: "6", ClassType: "CLIPTextEncode", Input: "text", Message: "must be a string, got 5"},
+				{NodeID: "8", ClassType: "VAEDecode", Input: "tiled", Message: "must be a boolean, got yes"},
+			},
+		},
+		{
+			name: "combo mismatch",
+			workflow: `{
+				"3": {"class_type": "KSampler", "inputs": {
+					"model": ["4", 0], "seed": 1, "steps": 20, "cfg": 7.5, "sampler_name": "ddim", "denoise": 1
+				}},
+				"10": {"class_type": "LoadImage", "inputs": {"image": "missing.png"}}
+			}`,
+			want: []NodeError{
+				{NodeID: "10", ClassType: "LoadImage", Input: "image", Message: "missing.png is not one of the available values [example.png]"},
+				{NodeID: "3", ClassType: "KSampler", Input: "sampler_name", Message: "ddim is not one of the available values [euler dpmpp_2m]"},
+			},
+		},
+		{
+			name:     "image listed in object_info",
+			workflow: `{"10": {"class_type": "LoadImage", "inputs": {"image": "example.png"}}}`,
+		},
+		{
+			name:     "image uploaded after object_info was fetched",
+			workflow: `{"10": {"class_type": "LoadImage", "inputs": {"image": "uploaded-cat.png"}}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := c.validate(context.Background(), []byte(tt.workflow))
+			if tt.want == nil {
+				if err != nil {
+					t.Fatalf("validate() = %v", err)
+				}
+				return
+			}
+
+			var validationErr *PromptValidationError
+			if !errors.As(err, &validationErr) {
+				t.Fatalf("validate() = %v, want a *PromptValidationError", err)
+			}
+			if !reflect.DeepEqual(validationErr.Errors, tt.want) {
+				t.Errorf("validate() errors = %+v, want %+v", validationErr.Errors, tt.want)
+			}
+			if !errors.Is(err, ErrPromptRejected) {
+				t.Error("validation error does not match ErrPromptRejected")
+			}
+		})
+	}
+}
+
+func TestPromptErrorFrom(t *testing.T) {
+	var nodeErrors comfyNodeErrors
+	err := json.Unmarshal([]byte(`{
+		"3": {"class_type": "KSampler", "errors": [
+			{"type": "value_not_in_list", "message": "Value not in list", "details": "sampler_name: 'ddim' not in ['euler']", "extra_info": {"input_name": "sampler_name"}},
+			{"type": "value_bigger_than_max", "message": "Value 101 bigger than max of 100", "extra_info": {"input_name": "cfg"}}
+		]},
+		"10": {"class_type": "LoadImage", "errors": [
+			{"type": "custom_validation_failed", "message": "Invalid image file", "details": "image - missing.png", "extra_info": {"input_name": "image"}}
+		]}
+	}`), &nodeErrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []NodeError{
+		{NodeID: "10", ClassType: "LoadImage", Input: "image", Message: "Invalid image file: image - missing.png"},
+		{NodeID: "3", ClassType: "KSampler", Input: "sampler_name", Message: "Value not in list: sampler_name: 'ddim' not in ['euler']"},
+		{NodeID: "3", ClassType: "KSampler", Input: "cfg", Message: "Value 101 bigger than max of 100"},
+	}
+	if got := promptErrorFrom(nodeErrors); got == nil || !reflect.DeepEqual(got.Errors, want) {
+		t.Errorf("promptErrorFrom() = %+v, want %+v", got, want)
+	}
+
+	if got := promptErrorFrom(comfyNodeErrors{}); got != nil {
+		t.Errorf("promptErrorFrom(empty) = %v, want nil", got)
+	}
+}
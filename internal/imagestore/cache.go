@@ -0,0 +1,140 @@
+package imagestore
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"image"
+	"sync"
+)
+
+// maxKnownSizes bounds how many source sizes TransformCache remembers before it starts over
+const maxKnownSizes = 10000
+
+// TransformCache keeps the results of Transform so repeated requests for the same variant of an
+// image are served without decoding and scaling it again. Concurrent requests for a variant that
+// is not cached yet wait for a single transform. Entries are evicted least recently used first
+// once the cached images exceed the size budget.
+type TransformCache struct {
+	mux      sync.Mutex
+	maxBytes int
+	size     int
+	entries  map[string]*list.Element
+	lru      *list.List
+	inFlight map[string]*transformCall
+	// sizes holds the dimensions of source images, so variants are keyed by the size Transform
+	// produces rather than the one requested. Stored images never change.
+	sizes map[string]image.Point
+}
+
+type transformEntry struct {
+	key         string
+	data        []byte
+	contentType string
+}
+
+// transformCall is a transform in progress that later requests for the same variant wait for.
+type transformCall struct {
+	done        chan struct{}
+	data        []byte
+	contentType string
+	err         error
+}
+
+// NewTransformCache returns a cache holding up to maxBytes of transformed images.
+func NewTransformCache(maxBytes int) *TransformCache {
+	return &TransformCache{
+		maxBytes: maxBytes,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+		inFlight: make(map[string]*transformCall),
+		sizes:    make(map[string]image.Point),
+	}
+}
+
+// Transform returns the cached variant of the image with the given ID, running Transform on data
+// from load if it is not cached. Requests that result in the same size, such as any width beyond
+// the source's, share an entry. load is only called on a cache miss or for an image not seen before.
+func (c *TransformCache) Transform(id string, load func() ([]byte, error), width, height int, format string, quality int) ([]byte, string, error) {
+	c.mux.Lock()
+	size, known := c.sizes[id]
+	c.mux.Unlock()
+
+	var data []byte
+	if !known {
+		var err error
+		if data, err = load(); err != nil {
+			return nil, "", err
+		}
+		config, _, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return nil, "", fmt.Errorf("%w: failed to decode image: %w", ErrInvalidTransform, err)
+		}
+		size = image.Pt(config.Width, config.Height)
+
+		c.mux.Lock()
+		if len(c.sizes) >= maxKnownSizes {
+			clear(c.sizes)
+		}
+		c.sizes[id] = size
+		c.mux.Unlock()
+	}
+
+	width, height, err := targetSize(size.X, size.Y, width, height)
+	if err != nil {
+		return nil, "", err
+	}
+	key := fmt.Sprintf("%s?w=%d&h=%d&format=%s&q=%d", id, width, height, format, quality)
+
+	c.mux.Lock()
+	if elem, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(elem)
+		entry := elem.Value.(*transformEntry)
+		c.mux.Unlock()
+		return entry.data, entry.contentType, nil
+	}
+	if call, ok := c.inFlight[key]; ok {
+		c.mux.Unlock()
+		<-call.done
+		return call.data, call.contentType, call.err
+	}
+	call := &transformCall{done: make(chan struct{})}
+	c.inFlight[key] = call
+	c.mux.Unlock()
+
+	if data == nil {
+		data, err = load()
+	}
+	if err == nil {
+		call.data, call.contentType, call.err = Transform(data, width, height, format, quality)
+	} else {
+		call.err = err
+	}
+
+	c.mux.Lock()
+	delete(c.inFlight, key)
+	if call.err == nil {
+		c.add(&transformEntry{key: key, data: call.data, contentType: call.contentType})
+	}
+	c.mux.Unlock()
+	close(call.done)
+
+	return call.data, call.contentType, call.err
+}
+
+// add inserts an entry and evicts the least recently used ones. Must be called with mux held.
+func (c *TransformCache) add(entry *transformEntry) {
+	if len(entry.data) > c.maxBytes {
+		return
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.size += len(entry.data)
+
+	for c.size > c.maxBytes {
+		oldest := c.lru.Back()
+		evicted := oldest.Value.(*transformEntry)
+		c.lru.Remove(oldest)
+		delete(c.entries, evicted.key)
+		c.size -= len(evicted.data)
+	}
+}
@@ -0,0 +1,102 @@
+package imagestore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+
+	"golang.org/x/image/draw"
+)
+
+// ErrInvalidTransform is returned by Transform for parameters it cannot apply to the image.
+var ErrInvalidTransform = errors.New("invalid image transform")
+
+// MaxDimension bounds the width and height Transform will produce.
+const MaxDimension = 4096
+
+// Transform scales an image down and re-encodes it. A zero width or height is derived from the
+// other keeping the aspect ratio; when both are zero the size is kept. Sizes larger than the
+// source are reduced to fit it. format is "png", "jpeg" or "gif", or empty to keep the source
+// format. quality only applies to JPEG, zero means the default.
+func Transform(data []byte, width, height int, format string, quality int) ([]byte, string, error) {
+	src, srcFormat, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: failed to decode image: %w", ErrInvalidTransform, err)
+	}
+	if format == "" {
+		format = srcFormat
+	}
+
+	bounds := src.Bounds()
+	width, height, err = targetSize(bounds.Dx(), bounds.Dy(), width, height)
+	if err != nil {
+		return nil, "", err
+	}
+
+	dst := src
+	if width != bounds.Dx() || height != bounds.Dy() {
+		dst = scale(src, width, height)
+	}
+
+	var buf bytes.Buffer
+	var contentType string
+	switch format {
+	case "png":
+		contentType = "image/png"
+		err = png.Encode(&buf, dst)
+	case "jpeg", "jpg":
+		contentType = "image/jpeg"
+		if quality <= 0 {
+			quality = jpeg.DefaultQuality
+		}
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: min(quality, 100)})
+	case "gif":
+		contentType = "image/gif"
+		err = gif.Encode(&buf, dst, nil)
+	default:
+		return nil, "", fmt.Errorf("%w: unsupported image format %q", ErrInvalidTransform, format)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to encode image: %w", err)
+	}
+	return buf.Bytes(), contentType, nil
+}
+
+// targetSize returns the size Transform produces for a srcWidth x srcHeight image. Applying it to
+// its own result gives the same size, so it also serves as a canonical cache key.
+func targetSize(srcWidth, srcHeight, width, height int) (int, int, error) {
+	if srcWidth <= 0 || srcHeight <= 0 {
+		return 0, 0, fmt.Errorf("%w: image is empty", ErrInvalidTransform)
+	}
+	switch {
+	case width == 0 && height == 0:
+		width, height = srcWidth, srcHeight
+	case width == 0:
+		width = max(1, srcWidth*height/srcHeight)
+	case height == 0:
+		height = max(1, srcHeight*width/srcWidth)
+	}
+	// Images are never enlarged, upscaling adds no detail and only costs CPU. The requested box
+	// shrinks to fit the source so its aspect ratio is kept.
+	if width > srcWidth {
+		width, height = srcWidth, max(1, height*srcWidth/width)
+	}
+	if height > srcHeight {
+		width, height = max(1, width*srcHeight/height), srcHeight
+	}
+	if width > MaxDimension || height > MaxDimension {
+		return 0, 0, fmt.Errorf("%w: image dimensions are limited to %dx%d", ErrInvalidTransform, MaxDimension, MaxDimension)
+	}
+	return width, height, nil
+}
+
+// scale resizes src with bilinear interpolation.
+func scale(src image.Image, width, height int) image.Image {
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.BiLinear.Scale(dst, dst.Bounds(), src, src.Bounds(), draw.Src, nil)
+	return dst
+}
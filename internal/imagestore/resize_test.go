@@ -0,0 +1,116 @@
+package imagestore
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/png"
+	"testing"
+)
+
+func TestTargetSize(t *testing.T) {
+	tests := []struct {
+		name                  string
+		srcWidth, srcHeight   int
+		width, height         int
+		wantWidth, wantHeight int
+		wantErr               bool
+	}{
+		{name: "keep size", srcWidth: 1024, srcHeight: 768, wantWidth: 1024, wantHeight: 768},
+		{name: "width only", srcWidth: 1024, srcHeight: 768, width: 512, wantWidth: 512, wantHeight: 384},
+		{name: "height only", srcWidth: 1024, srcHeight: 768, height: 384, wantWidth: 512, wantHeight: 384},
+		{name: "both given", srcWidth: 1024, srcHeight: 768, width: 100, height: 100, wantWidth: 100, wantHeight: 100},
+		{name: "width beyond source", srcWidth: 1024, srcHeight: 768, width: 2048, wantWidth: 1024, wantHeight: 768},
+		{name: "width beyond max dimension", srcWidth: 1024, srcHeight: 768, width: 5000, wantWidth: 1024, wantHeight: 768},
+		{name: "height beyond max dimension", srcWidth: 1024, srcHeight: 768, height: 10000, wantWidth: 1024, wantHeight: 768},
+		{name: "box wider than source", srcWidth: 1024, srcHeight: 768, width: 2048, height: 512, wantWidth: 1024, wantHeight: 256},
+		{name: "box taller than source", srcWidth: 1024, srcHeight: 768, width: 512, height: 1536, wantWidth: 256, wantHeight: 768},
+		{name: "thin result", srcWidth: 1024, srcHeight: 1, width: 10, wantWidth: 10, wantHeight: 1},
+		{name: "large source scaled into limits", srcWidth: 8192, srcHeight: 4096, width: 4096, wantWidth: 4096, wantHeight: 2048},
+		{name: "large source kept", srcWidth: 8192, srcHeight: 4096, wantErr: true},
+		{name: "empty source", srcWidth: 0, srcHeight: 0, width: 10, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			width, height, err := targetSize(tt.srcWidth, tt.srcHeight, tt.width, tt.height)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidTransform) {
+					t.Errorf("targetSize() = %dx%d, %v, want ErrInvalidTransform", width, height, err)
+				}
+				return
+			}
+			if err != nil || width != tt.wantWidth || height != tt.wantHeight {
+				t.Fatalf("targetSize() = %dx%d, %v, want %dx%d", width, height, err, tt.wantWidth, tt.wantHeight)
+			}
+			// The result is canonical, the cache keys on it
+			if w, h, _ := targetSize(tt.srcWidth, tt.srcHeight, width, height); w != width || h != height {
+				t.Errorf("targetSize(%dx%d) = %dx%d, want it unchanged", width, height, w, h)
+			}
+		})
+	}
+}
+
+func testPNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestTransform(t *testing.T) {
+	src := testPNG(t, 40, 20)
+
+	data, contentType, err := Transform(src, 5000, 0, "jpeg", 0)
+	if err != nil {
+		t.Fatalf("Transform() = %v", err)
+	}
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || format != "jpeg" || contentType != "image/jpeg" || config.Width != 40 || config.Height != 20 {
+		t.Errorf("Transform(w=5000) = %s %dx%d (%s), %v, want a 40x20 JPEG", format, config.Width, config.Height, contentType, err)
+	}
+
+	data, _, err = Transform(src, 10, 0, "", 0)
+	if err != nil {
+		t.Fatalf("Transform() = %v", err)
+	}
+	config, format, _ = image.DecodeConfig(bytes.NewReader(data))
+	if format != "png" || config.Width != 10 || config.Height != 5 {
+		t.Errorf("Transform(w=10) = %s %dx%d, want a 10x5 PNG", format, config.Width, config.Height)
+	}
+
+	if _, _, err := Transform([]byte("not an image"), 10, 0, "", 0); !errors.Is(err, ErrInvalidTransform) {
+		t.Errorf("Transform(garbage) = %v, want ErrInvalidTransform", err)
+	}
+}
+
+func TestTransformCacheKeysOnEffectiveSize(t *testing.T) {
+	src := testPNG(t, 40, 20)
+	loads := 0
+	load := func() ([]byte, error) {
+		loads++
+		return src, nil
+	}
+
+	cache := NewTransformCache(1 << 20)
+	// Every one of these produces the unchanged 40x20 PNG
+	for _, size := range [][2]int{{5000, 0}, {40, 0}, {0, 20}, {80, 40}, {5000, 2500}} {
+		if _, _, err := cache.Transform("a.png", load, size[0], size[1], "png", 0); err != nil {
+			t.Fatalf("Transform(%dx%d) = %v", size[0], size[1], err)
+		}
+	}
+	if loads != 1 {
+		t.Errorf("loaded the image %d times, want once", loads)
+	}
+	if len(cache.entries) != 1 {
+		t.Errorf("cache holds %d variants, want 1", len(cache.entries))
+	}
+
+	if _, _, err := cache.Transform("a.png", load, 10, 0, "png", 0); err != nil {
+		t.Fatal(err)
+	}
+	if loads != 2 || len(cache.entries) != 2 {
+		t.Errorf("after a new size: %d loads and %d variants, want 2 and 2", loads, len(cache.entries))
+	}
+}
@@ -0,0 +1,127 @@
+package imagestore
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// S3Options configures an S3-compatible store such as AWS S3 or MinIO.
+type S3Options struct {
+	// Endpoint is the base URL of the service, e.g. https://s3.eu-west-1.amazonaws.com or http://localhost:9000
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// PathStyle addresses the bucket as Endpoint/bucket/key instead of bucket.host/key. MinIO needs this.
+	PathStyle bool
+	// PublicBaseURL, if set, is used for image URLs instead of presigned links, for public buckets or a CDN.
+	PublicBaseURL string
+	// URLExpiry is how long presigned URLs stay valid.
+	URLExpiry time.Duration
+}
+
+type s3Store struct {
+	opts     S3Options
+	endpoint *url.URL
+	signer   signer
+	client   *http.Client
+}
+
+func NewS3Store(opts S3Options) (ImageStore, error) {
+	endpoint, err := url.Parse(opts.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", opts.Endpoint)
+	}
+	if opts.Bucket == "" {
+		return nil, fmt.Errorf("no S3 bucket configured")
+	}
+	if opts.Region == "" {
+		opts.Region = "us-east-1"
+	}
+	if opts.URLExpiry <= 0 {
+		opts.URLExpiry = 24 * time.Hour
+	}
+	opts.PublicBaseURL = strings.TrimSuffix(opts.PublicBaseURL, "/")
+
+	return &s3Store{
+		opts:     opts,
+		endpoint: endpoint,
+		signer:   signer{accessKey: opts.AccessKey, secretKey: opts.SecretKey, region: opts.Region},
+		client:   &http.Client{Timeout: time.Minute},
+	}, nil
+}
+
+func (s *s3Store) objectURL(key string) *url.URL {
+	u := *s.endpoint
+	basePath := strings.TrimSuffix(u.Path, "/")
+	if s.opts.PathStyle {
+		u.Path = basePath + "/" + s.opts.Bucket + "/" + key
+	} else {
+		u.Host = s.opts.Bucket + "." + u.Host
+		u.Path = basePath + "/" + key
+	}
+	u.RawPath = ""
+	return &u
+}
+
+func (s *s3Store) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.objectURL(key).String(), bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to create S3 request: %w", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	sum := sha256.Sum256(data)
+	s.signer.sign(req, hex.EncodeToString(sum[:]), time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to upload image to S3: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+		return fmt.Errorf("received non-200 status from S3: %s: %s", resp.Status, body)
+	}
+	return nil
+}
+
+func (s *s3Store) Get(ctx context.Context, key string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.objectURL(key).String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create S3 request: %w", err)
+	}
+	emptySum := sha256.Sum256(nil)
+	s.signer.sign(req, hex.EncodeToString(emptySum[:]), time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download image from S3: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("received non-200 status from S3: %s", resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func (s *s3Store) URL(_ context.Context, key string) (string, error) {
+	if s.opts.PublicBaseURL != "" {
+		return s.opts.PublicBaseURL + "/" + key, nil
+	}
+	return s.signer.presign(http.MethodGet, s.objectURL(key), s.opts.URLExpiry, time.Now()).String(), nil
+}
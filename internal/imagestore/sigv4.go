@@ -0,0 +1,182 @@
+package imagestore
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Minimal AWS Signature Version 4 for the handful of S3 requests the store makes.
+// See https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-authenticating-requests.html
+
+const (
+	sigAlgorithm     = "AWS4-HMAC-SHA256"
+	sigTimeFormat    = "20060102T150405Z"
+	sigDateFormat    = "20060102"
+	unsignedPayload  = "UNSIGNED-PAYLOAD"
+	headerContentSHA = "X-Amz-Content-Sha256"
+)
+
+type signer struct {
+	accessKey string
+	secretKey string
+	region    string
+	// service is the signing name of the service, "s3" when empty
+	service string
+}
+
+// sign adds the Authorization header to req. payloadHash is the hex SHA-256 of the body.
+func (s signer) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format(sigTimeFormat)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set(headerContentSHA, payloadHash)
+
+	headers, signedHeaders := canonicalHeaders(req)
+	canonical := canonicalRequest(req.Method, req.URL, req.URL.Query(), headers, signedHeaders, payloadHash)
+
+	scope := s.scope(now)
+	signature := s.signature(now, stringToSign(amzDate, scope, canonical))
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s", sigAlgorithm, s.accessKey, scope, signedHeaders, signature))
+}
+
+// presign returns u with query string authentication valid for expires.
+func (s signer) presign(method string, u *url.URL, expires time.Duration, now time.Time) *url.URL {
+	query, canonical := s.presignRequest(method, u, expires, now)
+	query.Set("X-Amz-Signature", s.signature(now, stringToSign(now.UTC().Format(sigTimeFormat), s.scope(now), canonical)))
+
+	signed := *u
+	signed.RawQuery = canonicalQuery(query)
+	return &signed
+}
+
+// presignRequest returns the authentication query parameters of a presigned URL, without the
+// signature, and the canonical request the signature is computed from.
+func (s signer) presignRequest(method string, u *url.URL, expires time.Duration, now time.Time) (url.Values, string) {
+	query := u.Query()
+	query.Set("X-Amz-Algorithm", sigAlgorithm)
+	query.Set("X-Amz-Credential", s.accessKey+"/"+s.scope(now))
+	query.Set("X-Amz-Date", now.UTC().Format(sigTimeFormat))
+	query.Set("X-Amz-Expires", fmt.Sprint(int(expires.Seconds())))
+	query.Set("X-Amz-SignedHeaders", "host")
+
+	return query, canonicalRequest(method, u, query, "host:"+u.Host+"\n", "host", unsignedPayload)
+}
+
+// canonicalHeaders returns the canonical form of the headers that are signed, which are the host,
+// the content type and the x-amz-* headers, and the list of their names.
+func canonicalHeaders(req *http.Request) (string, string) {
+	headerNames := []string{"host"}
+	for name := range req.Header {
+		lower := strings.ToLower(name)
+		if lower == "content-type" || strings.HasPrefix(lower, "x-amz-") {
+			headerNames = append(headerNames, lower)
+		}
+	}
+	sort.Strings(headerNames)
+
+	var headers strings.Builder
+	for _, name := range headerNames {
+		value := req.Header.Get(name)
+		if name == "host" {
+			value = req.URL.Host
+		}
+		fmt.Fprintf(&headers, "%s:%s\n", name, strings.TrimSpace(value))
+	}
+	return headers.String(), strings.Join(headerNames, ";")
+}
+
+func canonicalRequest(method string, u *url.URL, query url.Values, headers, signedHeaders, payloadHash string) string {
+	return strings.Join([]string{
+		method,
+		canonicalURI(u),
+		canonicalQuery(query),
+		headers,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+}
+
+func (s signer) scope(now time.Time) string {
+	return fmt.Sprintf("%s/%s/%s/aws4_request", now.UTC().Format(sigDateFormat), s.region, s.serviceName())
+}
+
+func (s signer) serviceName() string {
+	if s.service == "" {
+		return "s3"
+	}
+	return s.service
+}
+
+func stringToSign(amzDate, scope, canonicalRequest string) string {
+	hashed := sha256.Sum256([]byte(canonicalRequest))
+	return strings.Join([]string{sigAlgorithm, amzDate, scope, hex.EncodeToString(hashed[:])}, "\n")
+}
+
+func (s signer) signature(now time.Time, toSign string) string {
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), now.UTC().Format(sigDateFormat))
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, s.serviceName())
+	key = hmacSHA256(key, "aws4_request")
+
+	return hex.EncodeToString(hmacSHA256(key, toSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(data))
+	return m.Sum(nil)
+}
+
+func canonicalURI(u *url.URL) string {
+	p := u.EscapedPath()
+	if p == "" {
+		return "/"
+	}
+	segments := strings.Split(p, "/")
+	for i, segment := range segments {
+		unescaped, err := url.PathUnescape(segment)
+		if err != nil {
+			unescaped = segment
+		}
+		segments[i] = uriEncode(unescaped)
+	}
+	return strings.Join(segments, "/")
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, key := range keys {
+		values := append([]string(nil), query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			parts = append(parts, uriEncode(key)+"="+uriEncode(value))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// uriEncode percent-encodes everything except the RFC 3986 unreserved characters, as SigV4 requires.
+func uriEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
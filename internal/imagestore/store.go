@@ -0,0 +1,81 @@
+package imagestore
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"image"
+	"mime"
+	"net/http"
+	"path"
+
+	// Register decoders so image.DecodeConfig can read dimensions
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+)
+
+// ErrNotFound is returned by Get when no image is stored under the key.
+var ErrNotFound = errors.New("image not found")
+
+// ImageStore persists generated images and hands out URLs to them.
+type ImageStore interface {
+	Put(ctx context.Context, key string, data []byte, contentType string) error
+	Get(ctx context.Context, key string) ([]byte, error)
+	// URL returns the address clients use to download the image.
+	URL(ctx context.Context, key string) (string, error)
+}
+
+// Info describes a stored image.
+type Info struct {
+	Key         string
+	ContentType string
+	Size        int
+	Width       int
+	Height      int
+	SHA256      string
+}
+
+// Describe inspects image data. Dimensions are left at zero for formats the standard library
+// cannot decode.
+func Describe(key string, data []byte) Info {
+	sum := sha256.Sum256(data)
+	info := Info{
+		Key:         key,
+		ContentType: http.DetectContentType(data),
+		Size:        len(data),
+		SHA256:      hex.EncodeToString(sum[:]),
+	}
+	if cfg, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+		info.Width, info.Height = cfg.Width, cfg.Height
+	}
+	return info
+}
+
+// Extension returns the file extension, including the dot, for an image content type.
+func Extension(contentType string) string {
+	switch contentType {
+	case "image/png":
+		return ".png"
+	case "image/jpeg":
+		return ".jpg"
+	case "image/webp":
+		return ".webp"
+	case "image/gif":
+		return ".gif"
+	}
+	if exts, err := mime.ExtensionsByType(contentType); err == nil && len(exts) > 0 {
+		return exts[0]
+	}
+	return ".bin"
+}
+
+// ContentType guesses the content type of a stored key from its extension.
+func ContentType(key string) string {
+	if ct := mime.TypeByExtension(path.Ext(key)); ct != "" {
+		return ct
+	}
+	return "application/octet-stream"
+}
@@ -0,0 +1,119 @@
+package notifier
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// delivery is a single webhook POST that has not been acknowledged yet.
+type delivery struct {
+	ID          string          `json:"id"`
+	URL         string          `json:"url"`
+	Secret      string          `json:"secret,omitempty"`
+	Body        json.RawMessage `json:"body"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt time.Time       `json:"next_attempt"`
+	CreatedAt   time.Time       `json:"created_at"`
+	LastError   string          `json:"last_error,omitempty"`
+}
+
+// outbox persists pending deliveries as one JSON file each so they survive a restart.
+// Deliveries that exhausted their attempts are moved to the failed/ subdirectory for inspection.
+// An empty dir keeps deliveries in memory only.
+type outbox struct {
+	dir string
+}
+
+func newOutbox(dir string) (*outbox, error) {
+	if dir == "" {
+		return &outbox{}, nil
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "failed"), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create webhook outbox: %w", err)
+	}
+	return &outbox{dir: dir}, nil
+}
+
+func (o *outbox) path(id string) string {
+	return filepath.Join(o.dir, id+".json")
+}
+
+// save writes the delivery atomically so a crash never leaves a half written file behind.
+func (o *outbox) save(d *delivery) error {
+	if o.dir == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(d)
+	if err != nil {
+		return fmt.Errorf("failed to marshal delivery: %w", err)
+	}
+
+	tmp := o.path(d.ID) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write delivery: %w", err)
+	}
+	if err := os.Rename(tmp, o.path(d.ID)); err != nil {
+		return fmt.Errorf("failed to write delivery: %w", err)
+	}
+	return nil
+}
+
+func (o *outbox) remove(id string) error {
+	if o.dir == "" {
+		return nil
+	}
+	if err := os.Remove(o.path(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove delivery: %w", err)
+	}
+	return nil
+}
+
+// fail moves a delivery that will not be retried again to the failed/ directory.
+func (o *outbox) fail(d *delivery) error {
+	if o.dir == "" {
+		return nil
+	}
+	if err := o.save(d); err != nil {
+		return err
+	}
+	if err := os.Rename(o.path(d.ID), filepath.Join(o.dir, "failed", d.ID+".json")); err != nil {
+		return fmt.Errorf("failed to move delivery to failed: %w", err)
+	}
+	return nil
+}
+
+// load returns every pending delivery found in the outbox.
+func (o *outbox) load() ([]*delivery, error) {
+	if o.dir == "" {
+		return nil, nil
+	}
+
+	entries, err := os.ReadDir(o.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read webhook outbox: %w", err)
+	}
+
+	var deliveries []*delivery
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(o.dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read delivery %s: %w", entry.Name(), err)
+		}
+		var d delivery
+		if err := json.Unmarshal(data, &d); err != nil {
+			fmt.Printf("Skipping unreadable webhook delivery %s: %v\n", entry.Name(), err)
+			continue
+		}
+		deliveries = append(deliveries, &d)
+	}
+	return deliveries, nil
+}
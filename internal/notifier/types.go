@@ -1,8 +1,43 @@
-package notifier
-
-type WebhookPayload struct {
-	Status   string   `json:"status"`
-	PromptID string   `json:"prompt_id"`
-	Images   []string `json:"images"`
-	Error    string   `json:"error,omitempty"`
-}
+package notifier
+
+// Webhook is where a job's result is delivered.
+type Webhook struct {
+	URL string
+	// Secret signs the deliveries. When empty the notifier's default secret is used.
+	Secret string
+	// InlineImages adds the base64 encoded images to the payload next to their URLs.
+	InlineImages bool
+}
+
+type WebhookPayload struct {
+	Status   string   `json:"status"`
+	PromptID string   `json:"prompt_id"`
+	Images   []string `json:"images,omitempty"`
+	Error    string   `json:"error,omitempty"`
+
+	// Outputs describes the stored images when an image store is configured.
+	Outputs []ImageOutput `json:"outputs,omitempty"`
+
+	ErrorDetails *ErrorDetails `json:"error_details,omitempty"`
+}
+
+// ImageOutput points at a generated image in the image store.
+type ImageOutput struct {
+	Index       int    `json:"index"`
+	URL         string `json:"url"`
+	ContentType string `json:"content_type"`
+	Size        int    `json:"size"`
+	Width       int    `json:"width,omitempty"`
+	Height      int    `json:"height,omitempty"`
+	SHA256      string `json:"sha256"`
+}
+
+// ErrorDetails is the structured error ComfyUI reported for a failed or interrupted prompt.
+type ErrorDetails struct {
+	NodeID        string   `json:"node_id,omitempty"`
+	NodeType      string   `json:"node_type,omitempty"`
+	ExceptionType string   `json:"exception_type,omitempty"`
+	Message       string   `json:"message,omitempty"`
+	Traceback     []string `json:"traceback,omitempty"`
+	Interrupted   bool     `json:"interrupted,omitempty"`
+}
@@ -1,47 +1,235 @@
-package notifier
-
-import (
-	"bytes"
-	"encoding/json"
-	"fmt"
-	"net/http"
-	"time"
-)
-
-type Notifier interface {
-	Notify(webhookURL string, payload WebhookPayload) error
-}
-
-type httpNotifier struct {
-	client *http.Client
-}
-
-func NewHTTPNotifier() Notifier {
-	return &httpNotifier{
-		client: &http.Client{Timeout: 10 * time.Second},
-	}
-}
-
-func (n *httpNotifier) Notify(webhookURL string, payload WebhookPayload) error {
-	body, err := json.Marshal(payload)
-	if err != nil {
-		return fmt.Errorf("failed to marshal webhook payload: %w", err)
-	}
-
-	go func() {
-		resp, err := n.client.Post(webhookURL, "application/json", bytes.NewBuffer(body))
-		if err != nil {
-			fmt.Printf("Error sending webhook to %s: %v\n", webhookURL, err)
-			return
-		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-			fmt.Printf("Received non-2xx status from webhook %s: %s\n", webhookURL, resp.Status)
-		} else {
-			fmt.Printf("Successfully sent webhook for prompt %s\n", payload.PromptID)
-		}
-	}()
-
-	return nil
-}
+package notifier
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/CP-Payne/comfylite/internal/publicnet"
+	"github.com/CP-Payne/comfylite/pkg/webhook"
+	"github.com/google/uuid"
+)
+
+type Notifier interface {
+	// Start resumes deliveries left in the outbox by a previous run. Deliveries are only attempted
+	// while ctx is alive; anything pending when it is cancelled stays in the outbox.
+	Start(ctx context.Context) error
+	Notify(webhook Webhook, payload WebhookPayload) error
+}
+
+// Options configures webhook delivery.
+type Options struct {
+	// OutboxDir is where pending deliveries are persisted. Empty keeps them in memory only.
+	OutboxDir string
+	// MaxAttempts is the total number of delivery attempts before a webhook is given up on.
+	MaxAttempts int
+	// BaseDelay is the delay before the first retry, doubled on every further attempt up to MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// Secret signs deliveries whose Webhook has no secret of its own. Empty leaves them unsigned.
+	Secret string
+	// AllowPrivateAddresses lets webhooks reach loopback, private and link-local addresses. Webhook
+	// URLs come from API callers, so by default only public addresses are contacted.
+	AllowPrivateAddresses bool
+}
+
+// deliveryTimeout bounds a single delivery attempt
+const deliveryTimeout = 10 * time.Second
+
+type httpNotifier struct {
+	client *http.Client
+	outbox *outbox
+	opts   Options
+
+	// ctx is set by Start and read by the delivery goroutines, guarded by ctxMux
+	ctx    context.Context
+	ctxMux sync.RWMutex
+}
+
+func NewHTTPNotifier(opts Options) (Notifier, error) {
+	outbox, err := newOutbox(opts.OutboxDir)
+	if err != nil {
+		return nil, err
+	}
+	if opts.MaxAttempts < 1 {
+		opts.MaxAttempts = 1
+	}
+	if opts.MaxDelay < opts.BaseDelay {
+		opts.MaxDelay = opts.BaseDelay
+	}
+
+	client := publicnet.NewClient(deliveryTimeout)
+	if opts.AllowPrivateAddresses {
+		client = &http.Client{Timeout: deliveryTimeout}
+	}
+
+	return &httpNotifier{
+		client: client,
+		outbox: outbox,
+		opts:   opts,
+		ctx:    context.Background(),
+	}, nil
+}
+
+func (n *httpNotifier) Start(ctx context.Context) error {
+	n.ctxMux.Lock()
+	n.ctx = ctx
+	n.ctxMux.Unlock()
+
+	deliveries, err := n.outbox.load()
+	if err != nil {
+		return err
+	}
+	if len(deliveries) > 0 {
+		fmt.Printf("Resuming %d pending webhook deliveries\n", len(deliveries))
+	}
+	for _, d := range deliveries {
+		go n.deliver(d)
+	}
+	return nil
+}
+
+// Notify queues the payload in the outbox and delivers it in the background, retrying with
+// exponential backoff until the receiver answers with a 2xx status or the attempts run out.
+func (n *httpNotifier) Notify(webhook Webhook, payload WebhookPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal webhook payload: %w", err)
+	}
+
+	now := time.Now()
+	d := &delivery{
+		ID:          uuid.NewString(),
+		URL:         webhook.URL,
+		Secret:      cmp.Or(webhook.Secret, n.opts.Secret),
+		Body:        body,
+		NextAttempt: now,
+		CreatedAt:   now,
+	}
+	if err := n.outbox.save(d); err != nil {
+		return err
+	}
+
+	go n.deliver(d)
+
+	return nil
+}
+
+// context returns the context deliveries run under.
+func (n *httpNotifier) context() context.Context {
+	n.ctxMux.RLock()
+	defer n.ctxMux.RUnlock()
+
+	return n.ctx
+}
+
+func (n *httpNotifier) deliver(d *delivery) {
+	for {
+		if wait := time.Until(d.NextAttempt); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-n.context().Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+		}
+
+		d.Attempts++
+		retryAfter, retry, err := n.post(d)
+		if err == nil {
+			fmt.Printf("Successfully sent webhook %s to %s\n", d.ID, d.URL)
+			if err := n.outbox.remove(d.ID); err != nil {
+				fmt.Printf("Error removing webhook %s from outbox: %v\n", d.ID, err)
+			}
+			return
+		}
+
+		d.LastError = err.Error()
+		if !retry || d.Attempts >= n.opts.MaxAttempts {
+			fmt.Printf("Giving up on webhook %s to %s after %d attempts: %v\n", d.ID, d.URL, d.Attempts, err)
+			if err := n.outbox.fail(d); err != nil {
+				fmt.Printf("Error moving webhook %s out of outbox: %v\n", d.ID, err)
+			}
+			return
+		}
+
+		d.NextAttempt = time.Now().Add(n.retryDelay(d.Attempts, retryAfter))
+		fmt.Printf("Webhook %s to %s failed (attempt %d/%d), retrying at %s: %v\n", d.ID, d.URL, d.Attempts, n.opts.MaxAttempts, d.NextAttempt.Format(time.RFC3339), err)
+		if err := n.outbox.save(d); err != nil {
+			fmt.Printf("Error saving webhook %s to outbox: %v\n", d.ID, err)
+		}
+	}
+}
+
+// post makes a single delivery attempt. It reports how long the receiver asked to wait via
+// Retry-After and whether the failure is worth retrying.
+func (n *httpNotifier) post(d *delivery) (time.Duration, bool, error) {
+	req, err := http.NewRequestWithContext(n.context(), http.MethodPost, d.URL, bytes.NewReader(d.Body))
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	// Every attempt is signed with a fresh timestamp so retries pass the receiver's tolerance check
+	if d.Secret != "" {
+		webhook.SetHeaders(req.Header, []byte(d.Secret), d.ID, time.Now(), d.Body)
+	} else {
+		req.Header.Set(webhook.HeaderDelivery, d.ID)
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		// The address will not become public by retrying
+		return 0, !errors.Is(err, publicnet.ErrForbiddenAddress), err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return 0, false, nil
+	}
+
+	retry := resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return parseRetryAfter(resp.Header.Get("Retry-After")), retry, fmt.Errorf("received non-2xx status: %s", resp.Status)
+}
+
+// retryDelay returns the delay before the given retry. A Retry-After longer than the backoff is
+// honoured up to MaxDelay, so a receiver cannot park a delivery indefinitely.
+func (n *httpNotifier) retryDelay(attempt int, retryAfter time.Duration) time.Duration {
+	return max(n.backoff(attempt), min(retryAfter, n.opts.MaxDelay))
+}
+
+// backoff returns the delay before the given retry with full jitter.
+func (n *httpNotifier) backoff(attempt int) time.Duration {
+	ceiling := n.opts.MaxDelay
+	if shift := attempt - 1; shift < 32 && n.opts.BaseDelay<<shift < ceiling {
+		ceiling = n.opts.BaseDelay << shift
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int64N(int64(ceiling)) + 1)
+}
+
+// parseRetryAfter understands both forms of the header: delay seconds and an HTTP date.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return time.Until(at)
+	}
+	return 0
+}
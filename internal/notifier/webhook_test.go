@@ -0,0 +1,120 @@
+package notifier
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/CP-Payne/comfylite/internal/publicnet"
+)
+
+func newTestNotifier(t *testing.T, baseDelay, maxDelay time.Duration) *httpNotifier {
+	t.Helper()
+	n, err := NewHTTPNotifier(Options{MaxAttempts: 5, BaseDelay: baseDelay, MaxDelay: maxDelay})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n.(*httpNotifier)
+}
+
+func TestBackoff(t *testing.T) {
+	n := newTestNotifier(t, 2*time.Second, 10*time.Minute)
+
+	tests := []struct {
+		attempt int
+		ceiling time.Duration
+	}{
+		{attempt: 1, ceiling: 2 * time.Second},
+		{attempt: 2, ceiling: 4 * time.Second},
+		{attempt: 5, ceiling: 32 * time.Second},
+		{attempt: 9, ceiling: 512 * time.Second},
+		{attempt: 10, ceiling: 10 * time.Minute},
+		// Shifts that would overflow stay at the maximum
+		{attempt: 40, ceiling: 10 * time.Minute},
+		{attempt: 100, ceiling: 10 * time.Minute},
+	}
+	for _, tt := range tests {
+		for range 100 {
+			if got := n.backoff(tt.attempt); got <= 0 || got > tt.ceiling {
+				t.Fatalf("backoff(%d) = %s, want within (0, %s]", tt.attempt, got, tt.ceiling)
+			}
+		}
+	}
+
+	if got := newTestNotifier(t, 0, 0).backoff(3); got != 0 {
+		t.Errorf("backoff without delays = %s, want 0", got)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	n := newTestNotifier(t, time.Second, time.Minute)
+
+	tests := []struct {
+		name       string
+		retryAfter time.Duration
+		min, max   time.Duration
+	}{
+		{name: "no header", retryAfter: 0, min: 1, max: time.Second},
+		{name: "longer than backoff", retryAfter: 30 * time.Second, min: 30 * time.Second, max: 30 * time.Second},
+		{name: "capped at max delay", retryAfter: 24 * time.Hour, min: time.Minute, max: time.Minute},
+		{name: "date in the past", retryAfter: -time.Hour, min: 1, max: time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := n.retryDelay(1, tt.retryAfter); got < tt.min || got > tt.max {
+				t.Errorf("retryDelay(1, %s) = %s, want within [%s, %s]", tt.retryAfter, got, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		min, max time.Duration
+	}{
+		{name: "empty", value: ""},
+		{name: "seconds", value: "120", min: 120 * time.Second, max: 120 * time.Second},
+		{name: "zero", value: "0"},
+		{name: "negative", value: "-5"},
+		{name: "garbage", value: "soon"},
+		{name: "http date", value: time.Now().Add(time.Hour).UTC().Format(http.TimeFormat), min: 59 * time.Minute, max: time.Hour},
+		{name: "http date in the past", value: time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), min: -2 * time.Hour, max: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseRetryAfter(tt.value); got < tt.min || got > tt.max {
+				t.Errorf("parseRetryAfter(%q) = %s, want within [%s, %s]", tt.value, got, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func TestPostRefusesPrivateAddresses(t *testing.T) {
+	received := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received++
+	}))
+	defer server.Close()
+	d := &delivery{ID: "d1", URL: server.URL, Body: []byte(`{}`)}
+
+	n := newTestNotifier(t, time.Second, time.Minute)
+	_, retry, err := n.post(d)
+	if !errors.Is(err, publicnet.ErrForbiddenAddress) || retry {
+		t.Errorf("post() = retry %t, %v, want ErrForbiddenAddress without retry", retry, err)
+	}
+	if received != 0 {
+		t.Errorf("the receiver got %d requests, want none", received)
+	}
+
+	allowed, err := NewHTTPNotifier(Options{AllowPrivateAddresses: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := allowed.(*httpNotifier).post(d); err != nil || received != 1 {
+		t.Errorf("post() with private addresses allowed = %v after %d requests, want one delivery", err, received)
+	}
+}
@@ -0,0 +1,60 @@
+// Package publicnet provides an HTTP client for URLs supplied by API callers, such as input
+// images and webhooks, that refuses to connect to anything but public addresses.
+package publicnet
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// ErrForbiddenAddress is returned when a URL resolves to an address that is not public
+var ErrForbiddenAddress = errors.New("address is not publicly routable")
+
+// maxRedirects is how many redirects the client follows
+const maxRedirects = 3
+
+// cgnat is the shared address space of carrier-grade NAT, which net.IP.IsPrivate does not cover
+var cgnat = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// NewClient returns a client that only connects to public addresses. The check runs on the
+// resolved address of every connection, so DNS names and redirects cannot point it at internal
+// services such as ComfyUI or a cloud metadata endpoint.
+func NewClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !IsPublic(ip) {
+				return fmt.Errorf("%w: %s", ErrForbiddenAddress, host)
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return errors.New("too many redirects")
+			}
+			return nil
+		},
+	}
+}
+
+// IsPublic reports whether ip is routable on the internet, as opposed to loopback, private,
+// link-local, multicast or carrier-grade NAT addresses.
+func IsPublic(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() && !ip.IsMulticast() && !ip.IsUnspecified() && !cgnat.Contains(ip)
+}
@@ -0,0 +1,51 @@
+package publicnet
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestIsPublic(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{ip: "93.184.216.34", want: true},
+		{ip: "2606:2800:220:1:248:1893:25c8:1946", want: true},
+		{ip: "127.0.0.1"},
+		{ip: "::1"},
+		{ip: "10.1.2.3"},
+		{ip: "172.16.0.1"},
+		{ip: "192.168.1.1"},
+		{ip: "fd00::1"},
+		{ip: "169.254.169.254"},
+		{ip: "fe80::1"},
+		{ip: "100.64.0.1"},
+		{ip: "100.127.255.254"},
+		{ip: "100.128.0.1", want: true},
+		{ip: "224.0.0.1"},
+		{ip: "0.0.0.0"},
+		{ip: "::"},
+	}
+	for _, tt := range tests {
+		if got := IsPublic(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("IsPublic(%s) = %t, want %t", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestClientRefusesLoopback(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("the server was contacted")
+	}))
+	defer server.Close()
+
+	_, err := NewClient(time.Second).Get(server.URL)
+	if !errors.Is(err, ErrForbiddenAddress) {
+		t.Errorf("Get(%s) = %v, want ErrForbiddenAddress", server.URL, err)
+	}
+}
@@ -0,0 +1,134 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/CP-Payne/comfylite/internal/comfy"
+	"github.com/CP-Payne/comfylite/internal/imagestore"
+	"github.com/CP-Payne/comfylite/internal/workflow"
+	"github.com/google/uuid"
+)
+
+// maxInputImageSize caps images fetched from URLs
+const maxInputImageSize = 32 << 20
+
+// imageFetchTimeout bounds the download of an image given as a URL
+const imageFetchTimeout = 30 * time.Second
+
+// InputOptions controls where input images may come from.
+type InputOptions struct {
+	// AllowImageURLs lets requests pass images as http(s) URLs that ComfyLite fetches. Addresses
+	// on loopback, private and link-local networks are refused even then.
+	AllowImageURLs bool
+}
+
+// uploadInputs uploads the images and masks in params to ComfyUI and replaces them with the names
+// LoadImage knows them by. Masks are uploaded after images, as a mask with mask_of is merged into
+// the alpha channel of its image and both parameters then point to the merged upload.
+func (s *service) uploadInputs(ctx context.Context, workflowName string, config *workflow.WorkflowConfig, params map[string]any) error {
+	validationErr := &workflow.ValidationError{Workflow: workflowName}
+
+	images := make(map[string]workflow.InputImage)
+	for _, name := range config.ParamNames() {
+		image, ok := params[name].(workflow.InputImage)
+		if !ok {
+			continue
+		}
+		if image.URL != "" {
+			if s.imageFetcher == nil {
+				validationErr.Fields = append(validationErr.Fields, workflow.FieldError{Field: name, Message: "image URLs are not enabled, send the image as base64 or a file"})
+				continue
+			}
+			fetched, err := s.fetchImage(ctx, image.URL)
+			if err != nil {
+				// The cause stays in the log, it would tell clients about hosts they cannot reach
+				log.Printf("Failed to fetch image %s for parameter %s: %v", image.URL, name, err)
+				validationErr.Fields = append(validationErr.Fields, workflow.FieldError{Field: name, Message: "failed to fetch image"})
+				continue
+			}
+			image = fetched
+		}
+		images[name] = image
+	}
+	if len(validationErr.Fields) > 0 {
+		return validationErr
+	}
+
+	upload := func(name string, image workflow.InputImage, maskOf string) error {
+		uploaded, err := s.comfyClient.UploadImage(ctx, comfy.Upload{
+			Data:   image.Data,
+			Name:   uuid.New().String() + imagestore.Extension(image.ContentType),
+			MaskOf: maskOf,
+		}, config.Requires)
+		if err != nil {
+			return fmt.Errorf("failed to upload parameter %s: %w", name, err)
+		}
+		params[name] = workflow.UploadedImage(uploaded)
+		return nil
+	}
+
+	for _, name := range config.ParamNames() {
+		if image, ok := images[name]; ok && config.Mappings[name].Type == workflow.TypeImage {
+			if err := upload(name, image, ""); err != nil {
+				return err
+			}
+		}
+	}
+	for _, name := range config.ParamNames() {
+		image, ok := images[name]
+		if !ok || config.Mappings[name].Type != workflow.TypeMask {
+			continue
+		}
+		maskOf := config.Mappings[name].MaskOf
+		target, ok := params[maskOf].(workflow.UploadedImage)
+		if !ok {
+			// Without an image to merge into, the mask is uploaded on its own
+			if err := upload(name, image, ""); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := upload(name, image, string(target)); err != nil {
+			return err
+		}
+		params[maskOf] = params[name]
+	}
+
+	return nil
+}
+
+// fetchImage downloads an image parameter given as a URL.
+func (s *service) fetchImage(ctx context.Context, url string) (workflow.InputImage, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return workflow.InputImage{}, err
+	}
+	resp, err := s.imageFetcher.Do(req)
+	if err != nil {
+		return workflow.InputImage{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return workflow.InputImage{}, fmt.Errorf("received non-200 status: %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxInputImageSize+1))
+	if err != nil {
+		return workflow.InputImage{}, err
+	}
+	if len(data) > maxInputImageSize {
+		return workflow.InputImage{}, fmt.Errorf("image is larger than %d MB", maxInputImageSize>>20)
+	}
+
+	contentType := http.DetectContentType(data)
+	if !strings.HasPrefix(contentType, "image/") {
+		return workflow.InputImage{}, fmt.Errorf("URL does not point to an image, got %s", contentType)
+	}
+	return workflow.InputImage{Data: data, ContentType: contentType, URL: url}, nil
+}
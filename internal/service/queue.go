@@ -0,0 +1,384 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/CP-Payne/comfylite/internal/comfy"
+	"github.com/CP-Payne/comfylite/internal/store"
+	"github.com/CP-Payne/comfylite/internal/tracker"
+	"github.com/CP-Payne/comfylite/internal/workflow"
+)
+
+// defaultJobDuration is assumed for Retry-After until a job has finished
+const defaultJobDuration = 30 * time.Second
+
+// QueueOptions bounds how much work is handed to ComfyUI at once and how it is shared.
+type QueueOptions struct {
+	// MaxInFlight is how many prompts may be submitted to ComfyUI without having finished.
+	// Zero or less means no limit.
+	MaxInFlight int
+	// MaxQueued is how many jobs may wait in ComfyLite for an in-flight slot.
+	MaxQueued int
+	// MaxQueuedPerTenant caps the waiting jobs of a single tenant. Zero or less means no limit.
+	MaxQueuedPerTenant int
+	// TenantWeights sets each tenant's share of the in-flight slots. Tenants not listed weigh 1.
+	TenantWeights map[string]int
+}
+
+// QueueFullError is returned when a job is rejected because the queue is full.
+type QueueFullError struct {
+	// RetryAfter estimates when the queue will have room again
+	RetryAfter time.Duration
+	// Tenant is set when only the tenant's own share of the queue is full
+	Tenant string
+}
+
+func (e *QueueFullError) Error() string {
+	if e.Tenant != "" {
+		return fmt.Sprintf("job queue is full for tenant %q, retry in %s", e.Tenant, e.RetryAfter.Round(time.Second))
+	}
+	return fmt.Sprintf("job queue is full, retry in %s", e.RetryAfter.Round(time.Second))
+}
+
+type queuedJob struct {
+	id       string
+	workflow []byte
+	// requires lists the backend tags the workflow needs
+	requires []string
+	tenant   string
+	priority int
+	// retry is the workflow's retry policy
+	retry workflow.RetryPolicy
+
+	// The fields below are guarded by the queue's mux.
+
+	// attempts counts the submissions so far
+	attempts int
+	// backends lists the backends the job was sent to, so a retry can prefer another one
+	backends    []string
+	submittedAt time.Time
+}
+
+// tenantQueue holds one tenant's waiting jobs, highest priority first and in arrival order within
+// a priority.
+type tenantQueue struct {
+	items []*queuedJob
+	// reserved counts jobs that were accepted but are still being prepared
+	reserved int
+	// pass is the tenant's virtual time. It advances by 1/weight for every dispatched job and the
+	// tenant with the lowest pass goes next, so tenants get slots in proportion to their weight.
+	pass float64
+}
+
+// jobQueue holds jobs until ComfyUI has a free in-flight slot. Tenants are served by weighted fair
+// share, and each tenant's jobs by priority.
+type jobQueue struct {
+	opts        QueueOptions
+	comfyClient comfy.Client
+	tracker     tracker.Tracker
+	jobs        store.JobStore
+
+	mux sync.Mutex
+	// tenants is keyed by tenant name. Entries are kept while idle so their pass is remembered.
+	tenants map[string]*tenantQueue
+	queued  int
+	// reserved counts jobs that were accepted but are still being prepared
+	reserved int
+	// active holds the jobs that took an in-flight slot, by ID
+	active map[string]*queuedJob
+	// delayed holds failed jobs waiting for their retry delay, by ID
+	delayed map[string]*queuedJob
+	// virtualTime is the pass of the last dispatched tenant. Tenants that were idle start from it
+	// so they cannot bank credit while they had nothing queued.
+	virtualTime float64
+	inFlight    int
+	// avgDuration is a moving average of how long a job holds an in-flight slot
+	avgDuration time.Duration
+	wake        chan struct{}
+}
+
+func newJobQueue(opts QueueOptions, cc comfy.Client, tracker tracker.Tracker, jobs store.JobStore) *jobQueue {
+	return &jobQueue{
+		opts:        opts,
+		comfyClient: cc,
+		tracker:     tracker,
+		jobs:        jobs,
+		tenants:     make(map[string]*tenantQueue),
+		active:      make(map[string]*queuedJob),
+		delayed:     make(map[string]*queuedJob),
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// enqueue adds a job unless the queue is full. prepare runs once the job has been accepted and
+// before it is queued, so the job is recorded and tracked before it can be submitted.
+func (q *jobQueue) enqueue(job *queuedJob, prepare func() error) error {
+	q.mux.Lock()
+	if q.opts.MaxInFlight > 0 && q.queued+q.reserved >= q.opts.MaxQueued+q.opts.MaxInFlight-q.inFlight {
+		err := &QueueFullError{RetryAfter: q.retryAfter()}
+		q.mux.Unlock()
+		return err
+	}
+	tq := q.tenants[job.tenant]
+	if tq == nil {
+		tq = &tenantQueue{}
+		q.tenants[job.tenant] = tq
+	}
+	if q.opts.MaxQueuedPerTenant > 0 && len(tq.items)+tq.reserved >= q.opts.MaxQueuedPerTenant {
+		err := &QueueFullError{RetryAfter: q.retryAfter(), Tenant: job.tenant}
+		q.mux.Unlock()
+		return err
+	}
+	// prepare subscribes to the tracker, whose hooks lock mux, so it runs unlocked with the job's
+	// place held
+	q.reserved++
+	tq.reserved++
+	q.mux.Unlock()
+
+	err := prepare()
+
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	q.reserved--
+	tq.reserved--
+	if err != nil {
+		return err
+	}
+	q.push(job, false)
+	return nil
+}
+
+// push adds a job to its tenant's queue. A job in front goes ahead of the jobs of the same
+// priority instead of behind them. Must be called with mux held.
+func (q *jobQueue) push(job *queuedJob, front bool) {
+	tq := q.tenants[job.tenant]
+	if tq == nil {
+		tq = &tenantQueue{}
+		q.tenants[job.tenant] = tq
+	}
+	if len(tq.items) == 0 {
+		tq.pass = max(tq.pass, q.virtualTime)
+	}
+
+	// Insert behind every job of a higher priority, and of the same priority unless in front
+	i := len(tq.items)
+	for i > 0 && (tq.items[i-1].priority < job.priority || front && tq.items[i-1].priority == job.priority) {
+		i--
+	}
+	tq.items = append(tq.items, nil)
+	copy(tq.items[i+1:], tq.items[i:])
+	tq.items[i] = job
+
+	q.queued++
+	q.signal()
+}
+
+// restore puts back a job recovered after a restart. A job that is in flight in ComfyUI takes a
+// slot again, even if that exceeds MaxInFlight, the others are queued without counting against
+// MaxQueued.
+func (q *jobQueue) restore(job *queuedJob, inFlight bool) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	if inFlight {
+		q.active[job.id] = job
+		q.inFlight++
+		return
+	}
+	q.push(job, false)
+}
+
+// remove drops a job that has not been submitted yet, or is waiting to be retried, and reports
+// whether it was found.
+func (q *jobQueue) remove(id string) bool {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	if _, ok := q.delayed[id]; ok {
+		delete(q.delayed, id)
+		return true
+	}
+	for _, tq := range q.tenants {
+		for i, job := range tq.items {
+			if job.id == id {
+				tq.items = append(tq.items[:i], tq.items[i+1:]...)
+				q.queued--
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// pop takes the next job from the tenant with the lowest pass. Must be called with mux held.
+func (q *jobQueue) pop() *queuedJob {
+	var name string
+	var next *tenantQueue
+	for n, tq := range q.tenants {
+		if len(tq.items) == 0 {
+			continue
+		}
+		// Ties go to the tenant name that sorts first so the order does not depend on map iteration
+		if next == nil || tq.pass < next.pass || (tq.pass == next.pass && n < name) {
+			name, next = n, tq
+		}
+	}
+	if next == nil {
+		return nil
+	}
+
+	job := next.items[0]
+	next.items = next.items[1:]
+	q.queued--
+
+	q.virtualTime = next.pass
+	next.pass += 1 / float64(q.weight(name))
+	return job
+}
+
+func (q *jobQueue) weight(tenant string) int {
+	if w := q.opts.TenantWeights[tenant]; w > 0 {
+		return w
+	}
+	return 1
+}
+
+// run submits queued jobs as in-flight slots free up until ctx is cancelled.
+func (q *jobQueue) run(ctx context.Context) {
+	for {
+		job := q.next(ctx)
+		if job == nil {
+			return
+		}
+		q.submit(ctx, job)
+	}
+}
+
+// next blocks until a job is queued and a slot is free, and takes the slot.
+func (q *jobQueue) next(ctx context.Context) *queuedJob {
+	for {
+		q.mux.Lock()
+		if q.queued > 0 && (q.opts.MaxInFlight <= 0 || q.inFlight < q.opts.MaxInFlight) {
+			job := q.pop()
+			q.active[job.id] = job
+			q.inFlight++
+			q.mux.Unlock()
+			return job
+		}
+		q.mux.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-q.wake:
+		}
+	}
+}
+
+func (q *jobQueue) submit(ctx context.Context, job *queuedJob) {
+	q.mux.Lock()
+	if _, ok := q.active[job.id]; !ok {
+		// Finalized while it was being dequeued, e.g. cancelled, which already freed the slot
+		q.mux.Unlock()
+		return
+	}
+	job.attempts++
+	job.submittedAt = time.Now()
+	attempt, avoid, submittedAt := job.attempts, slices.Clone(job.backends), job.submittedAt
+	q.mux.Unlock()
+
+	if attempt > 1 {
+		// A timed out attempt may still be running. It is stopped before the new one is submitted
+		// under the same prompt ID, and the tracker ignores its events until then.
+		if err := q.comfyClient.Abandon(ctx, job.id); err != nil {
+			log.Printf("Failed to stop previous attempt of job %s: %v", job.id, err)
+		}
+		q.tracker.Resubmitted(job.id)
+	}
+
+	// The attempt is recorded first, the tracker may finish it before Submit returns
+	q.updateJob(job.id, func(j *store.Job) {
+		j.Attempts = append(j.Attempts, store.Attempt{Number: attempt, SubmittedAt: submittedAt})
+	})
+
+	backend, err := q.comfyClient.Submit(job.id, job.workflow, comfy.SubmitOptions{Requires: job.requires, Avoid: avoid})
+	if backend != "" {
+		q.mux.Lock()
+		job.backends = append(job.backends, backend)
+		q.mux.Unlock()
+
+		q.updateJob(job.id, func(j *store.Job) {
+			if a := findAttempt(j, attempt); a != nil {
+				a.Backend = backend
+			}
+		})
+	}
+	if err != nil {
+		log.Printf("Failed to submit job %s: %v", job.id, err)
+		if err := q.tracker.Fail(job.id, fmt.Errorf("%w: %w", errSubmit, err)); err != nil {
+			log.Printf("Failing job %s: %v", job.id, err)
+		}
+		return
+	}
+
+	// A cancel that raced with the submission could not dequeue the prompt from ComfyUI yet
+	if j, err := q.jobs.Get(job.id); err == nil && j.Status == store.StatusCancelled {
+		if err := q.comfyClient.Dequeue(ctx, job.id); err != nil {
+			log.Printf("Failed to dequeue cancelled job %s: %v", job.id, err)
+		}
+	}
+}
+
+// finish is the tracker's Finished hook. It frees the job's in-flight slot.
+func (q *jobQueue) finish(id string, err error) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	delete(q.delayed, id)
+	job, ok := q.active[id]
+	if !ok {
+		return
+	}
+	delete(q.active, id)
+	q.endAttempt(id, job.attempts, err, "")
+
+	q.inFlight--
+	if job.attempts > 0 {
+		d := time.Since(job.submittedAt)
+		if q.avgDuration == 0 {
+			q.avgDuration = d
+		} else {
+			q.avgDuration = (4*q.avgDuration + d) / 5
+		}
+	}
+	q.signal()
+}
+
+func (q *jobQueue) updateJob(id string, fn func(job *store.Job)) {
+	if err := q.jobs.Update(id, fn); err != nil {
+		log.Printf("Error updating job %s: %v", id, err)
+	}
+}
+
+// retryAfter estimates how long until a slot frees up. Must be called with mux held.
+func (q *jobQueue) retryAfter() time.Duration {
+	avg := q.avgDuration
+	if avg == 0 {
+		avg = defaultJobDuration
+	}
+	wait := avg / time.Duration(max(1, q.opts.MaxInFlight))
+	return max(time.Second, wait)
+}
+
+func (q *jobQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,304 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/CP-Payne/comfylite/internal/store"
+)
+
+func newTestQueue(opts QueueOptions) *jobQueue {
+	return newJobQueue(opts, nil, nil, store.NewMemoryJobStore(0, 0))
+}
+
+type testPush struct {
+	id       string
+	tenant   string
+	priority int
+	front    bool
+}
+
+func (q *jobQueue) pushAll(pushes []testPush) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	for _, p := range pushes {
+		q.push(&queuedJob{id: p.id, tenant: p.tenant, priority: p.priority}, p.front)
+	}
+}
+
+// popAll takes jobs in dispatch order until the queue is empty.
+func (q *jobQueue) popAll() []string {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	var ids []string
+	for job := q.pop(); job != nil; job = q.pop() {
+		ids = append(ids, job.id)
+	}
+	return ids
+}
+
+func TestQueueDispatchOrder(t *testing.T) {
+	tests := []struct {
+		name    string
+		weights map[string]int
+		pushes  []testPush
+		want    []string
+	}{
+		{
+			name: "unequal backlogs alternate",
+			pushes: []testPush{
+				{id: "a1", tenant: "a"}, {id: "a2", tenant: "a"}, {id: "a3", tenant: "a"}, {id: "a4", tenant: "a"},
+				{id: "b1", tenant: "b"}, {id: "b2", tenant: "b"},
+			},
+			want: []string{"a1", "b1", "a2", "b2", "a3", "a4"},
+		},
+		{
+			name:    "weights share slots proportionally",
+			weights: map[string]int{"a": 2},
+			pushes: []testPush{
+				{id: "a1", tenant: "a"}, {id: "a2", tenant: "a"}, {id: "a3", tenant: "a"}, {id: "a4", tenant: "a"},
+				{id: "b1", tenant: "b"}, {id: "b2", tenant: "b"},
+			},
+			want: []string{"a1", "b1", "a2", "a3", "b2", "a4"},
+		},
+		{
+			name: "higher priority goes first",
+			pushes: []testPush{
+				{id: "low1", tenant: "a"}, {id: "high1", tenant: "a", priority: 5},
+				{id: "low2", tenant: "a"}, {id: "high2", tenant: "a", priority: 5},
+			},
+			want: []string{"high1", "high2", "low1", "low2"},
+		},
+		{
+			name: "priority does not jump other tenants",
+			pushes: []testPush{
+				{id: "a1", tenant: "a"}, {id: "a2", tenant: "a"},
+				{id: "b1", tenant: "b", priority: 10}, {id: "b2", tenant: "b", priority: 10},
+			},
+			want: []string{"a1", "b1", "a2", "b2"},
+		},
+		{
+			name: "retry jumps ahead of its priority",
+			pushes: []testPush{
+				{id: "x1", tenant: "a"}, {id: "x2", tenant: "a"},
+				{id: "retry", tenant: "a", front: true},
+			},
+			want: []string{"retry", "x1", "x2"},
+		},
+		{
+			name: "retry stays behind higher priorities",
+			pushes: []testPush{
+				{id: "high", tenant: "a", priority: 5}, {id: "x1", tenant: "a"},
+				{id: "retry", tenant: "a", front: true},
+			},
+			want: []string{"high", "retry", "x1"},
+		},
+		{
+			name: "equal passes go by tenant name",
+			pushes: []testPush{
+				{id: "z", tenant: "zeta"}, {id: "a", tenant: "alpha"}, {id: "m", tenant: "mid"},
+			},
+			want: []string{"a", "m", "z"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newTestQueue(QueueOptions{TenantWeights: tt.weights})
+			q.pushAll(tt.pushes)
+
+			if got := q.popAll(); !slices.Equal(got, tt.want) {
+				t.Errorf("dispatch order = %v, want %v", got, tt.want)
+			}
+			if q.queued != 0 {
+				t.Errorf("queued = %d after draining, want 0", q.queued)
+			}
+		})
+	}
+}
+
+func TestQueueIdleTenantBanksNoCredit(t *testing.T) {
+	q := newTestQueue(QueueOptions{})
+	q.pushAll([]testPush{{id: "a1", tenant: "a"}, {id: "a2", tenant: "a"}, {id: "a3", tenant: "a"}, {id: "a4", tenant: "a"}})
+
+	q.mux.Lock()
+	first := []string{q.pop().id, q.pop().id}
+	q.mux.Unlock()
+	if !slices.Equal(first, []string{"a1", "a2"}) {
+		t.Fatalf("dispatch order = %v, want [a1 a2]", first)
+	}
+
+	// b was idle while a ran two jobs. It joins at the pass of the last dispatch, so it goes next
+	// but then alternates with a instead of catching up with two turns in a row.
+	q.pushAll([]testPush{{id: "b1", tenant: "b"}, {id: "b2", tenant: "b"}, {id: "b3", tenant: "b"}})
+	if got, want := q.popAll(), []string{"b1", "a3", "b2", "a4", "b3"}; !slices.Equal(got, want) {
+		t.Errorf("dispatch order = %v, want %v", got, want)
+	}
+}
+
+func TestQueueRemove(t *testing.T) {
+	q := newTestQueue(QueueOptions{})
+	q.pushAll([]testPush{{id: "a1", tenant: "a"}, {id: "b1", tenant: "b"}, {id: "a2", tenant: "a"}})
+
+	if !q.remove("a1") {
+		t.Fatalf("remove(a1) = false, want true")
+	}
+	if q.remove("a1") {
+		t.Errorf("second remove(a1) = true, want false")
+	}
+	if got, want := q.popAll(), []string{"a2", "b1"}; !slices.Equal(got, want) {
+		t.Errorf("dispatch order = %v, want %v", got, want)
+	}
+}
+
+// enqueueJob enqueues a job whose preparation records it in the store, like submit does.
+func (q *jobQueue) enqueueJob(id, tenant string) error {
+	return q.enqueue(&queuedJob{id: id, tenant: tenant}, func() error {
+		return q.jobs.Create(&store.Job{ID: id, Status: store.StatusQueued, Tenant: tenant})
+	})
+}
+
+func TestQueueLimits(t *testing.T) {
+	tests := []struct {
+		name      string
+		opts      QueueOptions
+		jobs      []testPush
+		accepted  int
+		wantAfter time.Duration
+		// wantTenant is the tenant named in the rejection, empty when the whole queue is full
+		wantTenant string
+	}{
+		{
+			name:      "queue depth plus free slots",
+			opts:      QueueOptions{MaxInFlight: 1, MaxQueued: 2},
+			jobs:      []testPush{{id: "1", tenant: "a"}, {id: "2", tenant: "b"}, {id: "3", tenant: "a"}, {id: "4", tenant: "b"}},
+			accepted:  3,
+			wantAfter: defaultJobDuration,
+		},
+		{
+			name:      "retry hint shrinks with more slots",
+			opts:      QueueOptions{MaxInFlight: 3, MaxQueued: 0},
+			jobs:      []testPush{{id: "1", tenant: "a"}, {id: "2", tenant: "a"}, {id: "3", tenant: "a"}, {id: "4", tenant: "a"}},
+			accepted:  3,
+			wantAfter: defaultJobDuration / 3,
+		},
+		{
+			name:       "tenant over its own limit",
+			opts:       QueueOptions{MaxInFlight: 1, MaxQueued: 10, MaxQueuedPerTenant: 2},
+			jobs:       []testPush{{id: "1", tenant: "a"}, {id: "2", tenant: "a"}, {id: "3", tenant: "a"}},
+			accepted:   2,
+			wantAfter:  defaultJobDuration,
+			wantTenant: "a",
+		},
+		{
+			name:     "no limit without MaxInFlight",
+			opts:     QueueOptions{MaxQueued: 1},
+			jobs:     []testPush{{id: "1", tenant: "a"}, {id: "2", tenant: "a"}, {id: "3", tenant: "a"}},
+			accepted: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newTestQueue(tt.opts)
+
+			var rejected error
+			for i, job := range tt.jobs {
+				err := q.enqueueJob(job.id, job.tenant)
+				if i < tt.accepted {
+					if err != nil {
+						t.Fatalf("enqueue #%d = %v, want nil", i+1, err)
+					}
+					continue
+				}
+				rejected = err
+				break
+			}
+			if tt.accepted == len(tt.jobs) {
+				return
+			}
+
+			var queueFullErr *QueueFullError
+			if !errors.As(rejected, &queueFullErr) {
+				t.Fatalf("enqueue #%d = %v, want a *QueueFullError", tt.accepted+1, rejected)
+			}
+			if queueFullErr.Tenant != tt.wantTenant {
+				t.Errorf("Tenant = %q, want %q", queueFullErr.Tenant, tt.wantTenant)
+			}
+			if queueFullErr.RetryAfter != tt.wantAfter {
+				t.Errorf("RetryAfter = %s, want %s", queueFullErr.RetryAfter, tt.wantAfter)
+			}
+			if _, err := q.jobs.Get(tt.jobs[tt.accepted].id); err == nil {
+				t.Errorf("rejected job was prepared")
+			}
+		})
+	}
+}
+
+func TestQueueSlotFreedByFinish(t *testing.T) {
+	q := newTestQueue(QueueOptions{MaxInFlight: 1, MaxQueued: 1})
+	for _, id := range []string{"1", "2"} {
+		if err := q.enqueueJob(id, "a"); err != nil {
+			t.Fatalf("enqueue %s = %v", id, err)
+		}
+	}
+
+	// Taking the slot moves a job out of the queue but the in-flight job still counts
+	job := q.next(context.Background())
+	if job == nil || job.id != "1" {
+		t.Fatalf("next() = %v, want job 1", job)
+	}
+	var queueFullErr *QueueFullError
+	if err := q.enqueueJob("3", "a"); !errors.As(err, &queueFullErr) {
+		t.Fatalf("enqueue 3 with a job in flight = %v, want a *QueueFullError", err)
+	}
+
+	q.mux.Lock()
+	q.active[job.id].attempts = 1
+	q.active[job.id].submittedAt = time.Now().Add(-10 * time.Second)
+	q.mux.Unlock()
+	q.finish(job.id, nil)
+
+	if err := q.enqueueJob("3", "a"); err != nil {
+		t.Fatalf("enqueue 3 after finish = %v, want nil", err)
+	}
+	if q.inFlight != 0 {
+		t.Errorf("inFlight = %d after finish, want 0", q.inFlight)
+	}
+	// The retry hint follows how long jobs actually took
+	if got := q.retryAfter(); got < 9*time.Second || got > 11*time.Second {
+		t.Errorf("retryAfter() = %s, want about 10s", got)
+	}
+}
+
+func TestQueuePrepareFailureReleasesReservation(t *testing.T) {
+	q := newTestQueue(QueueOptions{MaxInFlight: 1, MaxQueued: 1, MaxQueuedPerTenant: 1})
+	prepareErr := errors.New("tracker unavailable")
+
+	err := q.enqueue(&queuedJob{id: "1", tenant: "a"}, func() error {
+		// The place is held while preparing, so it counts against both limits
+		if err := q.enqueueJob("2", "b"); err != nil {
+			t.Errorf("enqueue 2 while 1 is prepared = %v, want nil", err)
+		}
+		var queueFullErr *QueueFullError
+		if err := q.enqueueJob("3", "c"); !errors.As(err, &queueFullErr) {
+			t.Errorf("enqueue 3 while 1 is prepared = %v, want a *QueueFullError", err)
+		}
+		return prepareErr
+	})
+	if !errors.Is(err, prepareErr) {
+		t.Fatalf("enqueue 1 = %v, want %v", err, prepareErr)
+	}
+
+	if q.reserved != 0 || q.tenants["a"].reserved != 0 {
+		t.Errorf("reserved = %d, tenant reserved = %d after failed prepare, want 0", q.reserved, q.tenants["a"].reserved)
+	}
+	if q.queued != 1 {
+		t.Errorf("queued = %d, want 1", q.queued)
+	}
+	// Both the global and the tenant's place are free again
+	if err := q.enqueueJob("4", "a"); err != nil {
+		t.Errorf("enqueue 4 after failed prepare = %v, want nil", err)
+	}
+}
@@ -0,0 +1,118 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"time"
+
+	"github.com/CP-Payne/comfylite/internal/notifier"
+	"github.com/CP-Payne/comfylite/internal/store"
+	"github.com/CP-Payne/comfylite/internal/tracker"
+	"github.com/CP-Payne/comfylite/internal/workflow"
+)
+
+// Recover tracks the unfinished jobs in the job store again. Jobs that were submitted to ComfyUI
+// are handed to the ComfyUI client, which reconciles them against /queue and /history once it is
+// connected: finished prompts are collected, running ones followed and vanished ones failed as
+// backend_lost. Jobs that had not been submitted yet are queued again.
+func (s *service) Recover() {
+	jobs := s.jobs.Unfinished()
+	if len(jobs) == 0 {
+		return
+	}
+	log.Printf("Recovering %d unfinished jobs.", len(jobs))
+
+	for _, job := range jobs {
+		if err := s.recoverJob(job); err != nil {
+			log.Printf("Failed to recover job %s: %v", job.ID, err)
+		}
+	}
+}
+
+func (s *service) recoverJob(job *store.Job) error {
+	webhook := notifier.Webhook{URL: job.WebhookURL, Secret: job.WebhookSecret, InlineImages: job.InlineImages}
+
+	queued, results, buildErr := s.rebuild(job)
+	if _, err := s.tracker.Subscribe(job.ID, results, webhook); err != nil {
+		return err
+	}
+	// Failing through the tracker records the error and notifies the webhook
+	if buildErr != nil {
+		return s.tracker.Fail(job.ID, fmt.Errorf("failed to recover job: %w", buildErr))
+	}
+
+	var last *store.Attempt
+	if len(job.Attempts) > 0 {
+		last = &job.Attempts[len(job.Attempts)-1]
+	}
+
+	switch {
+	case last != nil && last.FinishedAt == nil && last.Backend != "":
+		queued.submittedAt = last.SubmittedAt
+		s.queue.restore(queued, true)
+		if !s.comfyClient.Adopt(job.ID, last.Backend) {
+			return s.tracker.Fail(job.ID, fmt.Errorf("%w: backend %s is no longer configured", tracker.ErrBackendLost, last.Backend))
+		}
+		log.Printf("Recovered job %s, reconciling it with %s.", job.ID, last.Backend)
+
+	default:
+		// Either never submitted, waiting for a retry, or stopped while being submitted
+		finishedAt := time.Now()
+		s.queue.updateJob(job.ID, func(j *store.Job) {
+			j.Status = store.StatusQueued
+			j.StartedAt = nil
+			j.Progress = nil
+			if a := findAttempt(j, queued.attempts); a != nil && a.FinishedAt == nil {
+				a.FinishedAt = &finishedAt
+				a.Error = "ComfyLite restarted while submitting the prompt"
+			}
+		})
+		s.queue.restore(queued, false)
+		log.Printf("Recovered job %s, queued it again.", job.ID)
+	}
+	return nil
+}
+
+// rebuild builds the job's workflow again from its recorded parameters. The results are usable
+// for tracking even when an error is returned.
+func (s *service) rebuild(job *store.Job) (*queuedJob, tracker.Results, error) {
+	results := tracker.Results{Count: 1}
+
+	config, err := s.workflowMgr.Config(job.Workflow)
+	if err != nil {
+		return nil, results, err
+	}
+
+	// Input images were uploaded before the job was recorded, its params hold their names
+	params := maps.Clone(job.Params)
+	for name, mapping := range config.Mappings {
+		if value, ok := params[name].(string); ok && (mapping.Type == workflow.TypeImage || mapping.Type == workflow.TypeMask) {
+			params[name] = workflow.UploadedImage(value)
+		}
+	}
+
+	finalWorkflow, err := s.workflowMgr.Build(job.Workflow, params)
+	if err != nil {
+		return nil, results, fmt.Errorf("failed to build workflow: %w", err)
+	}
+	if results, err = resultsOf(config, finalWorkflow, params); err != nil {
+		return nil, tracker.Results{Count: 1}, err
+	}
+
+	queued := &queuedJob{
+		id:       job.ID,
+		workflow: finalWorkflow,
+		requires: config.Requires,
+		tenant:   job.Tenant,
+		priority: job.Priority,
+		retry:    config.Retry,
+		attempts: len(job.Attempts),
+	}
+	for _, attempt := range job.Attempts {
+		if attempt.Backend != "" {
+			queued.backends = append(queued.backends, attempt.Backend)
+		}
+	}
+	return queued, results, nil
+}
@@ -0,0 +1,106 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/CP-Payne/comfylite/internal/comfy"
+	"github.com/CP-Payne/comfylite/internal/store"
+	"github.com/CP-Payne/comfylite/internal/tracker"
+	"github.com/CP-Payne/comfylite/internal/workflow"
+)
+
+// adoptingClient is a ComfyUI client that only knows which backends are configured.
+type adoptingClient struct {
+	comfy.Client
+	backends []string
+	adopted  map[string]string
+}
+
+func (c *adoptingClient) Adopt(promptID, backend string) bool {
+	if !slices.Contains(c.backends, backend) {
+		return false
+	}
+	c.adopted[promptID] = backend
+	return true
+}
+
+func TestRecoverFromFileStore(t *testing.T) {
+	workflows := t.TempDir()
+	files := map[string]string{
+		"test.json": `{
+			"1": {"class_type": "CLIPTextEncode", "inputs": {"text": ""}},
+			"9": {"class_type": "SaveImage", "inputs": {"images": ["8", 0]}}
+		}`,
+		"test.yaml": "node_mappings:\n  prompt: {node_id: \"1\", property: text, type: string}\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(workflows, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A previous run left these jobs unfinished
+	dir := t.TempDir()
+	jobs, err := store.NewFileJobStore(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := time.Now().Add(-time.Minute)
+	params := map[string]any{"prompt": "a cat"}
+	for _, job := range []*store.Job{
+		{ID: "never-submitted", Status: store.StatusQueued, Workflow: "test", Params: params, CreatedAt: created},
+		{ID: "submitting", Status: store.StatusQueued, Workflow: "test", Params: params, CreatedAt: created.Add(time.Second),
+			Attempts: []store.Attempt{{Number: 1, SubmittedAt: created}}},
+		{ID: "running", Status: store.StatusRunning, Workflow: "test", Params: params, CreatedAt: created.Add(2 * time.Second),
+			Attempts: []store.Attempt{{Number: 1, Backend: "http://comfy-1:8188", SubmittedAt: created}}},
+		{ID: "removed-backend", Status: store.StatusRunning, Workflow: "test", Params: params, CreatedAt: created.Add(3 * time.Second),
+			Attempts: []store.Attempt{{Number: 1, Backend: "http://comfy-2:8188", SubmittedAt: created}}},
+	} {
+		if err := jobs.Create(job); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	jobs, err = store.NewFileJobStore(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &adoptingClient{backends: []string{"http://comfy-1:8188"}, adopted: make(map[string]string)}
+	s := NewService(workflow.NewManager(workflows, workflows), client, tracker.New(nil, jobs, nil), jobs, nil,
+		QueueOptions{MaxInFlight: 4}, InputOptions{}).(*service)
+	s.Recover()
+
+	if got := s.queue.popAll(); !slices.Equal(got, []string{"never-submitted", "submitting"}) {
+		t.Errorf("queued again = %v, want never-submitted, submitting", got)
+	}
+	if client.adopted["running"] != "http://comfy-1:8188" || len(client.adopted) != 1 {
+		t.Errorf("adopted = %v, want only running", client.adopted)
+	}
+	if s.queue.inFlight != 1 {
+		t.Errorf("in flight = %d, want 1 for the adopted job", s.queue.inFlight)
+	}
+
+	job, err := jobs.Get("submitting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Status != store.StatusQueued || job.Attempts[0].FinishedAt == nil || job.Attempts[0].Error == "" {
+		t.Errorf("submitting = %+v, want queued with its interrupted attempt finished", job)
+	}
+
+	job, err = jobs.Get("removed-backend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Status != store.StatusFailed || job.Error == nil {
+		t.Fatalf("removed-backend = %+v, want failed", job)
+	}
+	if !strings.Contains(job.Error.Message, tracker.ErrBackendLost.Error()) {
+		t.Errorf("removed-backend error = %q, want %q", job.Error.Message, tracker.ErrBackendLost)
+	}
+}
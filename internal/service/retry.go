@@ -0,0 +1,107 @@
+package service
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/CP-Payne/comfylite/internal/comfy"
+	"github.com/CP-Payne/comfylite/internal/store"
+	"github.com/CP-Payne/comfylite/internal/tracker"
+	"github.com/CP-Payne/comfylite/internal/workflow"
+)
+
+// errSubmit wraps errors of handing a prompt to ComfyUI
+var errSubmit = errors.New("failed to send workflow request")
+
+// retry is the tracker's Retry hook. It records the failed attempt and, if the workflow's retry
+// policy allows another one, frees the job's slot and queues it again after the policy's delay.
+func (q *jobQueue) retry(id string, err error) bool {
+	class := classify(err)
+
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	job, ok := q.active[id]
+	if !ok {
+		return false
+	}
+	q.endAttempt(id, job.attempts, err, class)
+	if !job.retry.ShouldRetry(job.attempts, class) {
+		return false
+	}
+
+	delete(q.active, id)
+	q.inFlight--
+	q.updateJob(id, func(j *store.Job) {
+		j.Status = store.StatusQueued
+		j.StartedAt = nil
+		j.Progress = nil
+	})
+
+	q.delayed[id] = job
+	time.AfterFunc(job.retry.Delay, func() {
+		q.mux.Lock()
+		defer q.mux.Unlock()
+
+		// Cancelled while waiting
+		if q.delayed[id] != job {
+			return
+		}
+		delete(q.delayed, id)
+		q.push(job, true)
+	})
+
+	q.signal()
+	return true
+}
+
+// endAttempt records how an attempt ended unless it already has. Must be called with mux held.
+func (q *jobQueue) endAttempt(id string, number int, err error, class workflow.ErrorClass) {
+	finishedAt := time.Now()
+	q.updateJob(id, func(j *store.Job) {
+		a := findAttempt(j, number)
+		if a == nil || a.FinishedAt != nil {
+			return
+		}
+		a.FinishedAt = &finishedAt
+		if err != nil {
+			a.Error = err.Error()
+			a.ErrorClass = string(class)
+		}
+	})
+}
+
+func findAttempt(job *store.Job, number int) *store.Attempt {
+	for i := range job.Attempts {
+		if job.Attempts[i].Number == number {
+			return &job.Attempts[i]
+		}
+	}
+	return nil
+}
+
+// classify maps a prompt's error to the class retry policies refer to. Errors without a class,
+// such as interrupted prompts or failed uploads, are never retried.
+func classify(err error) workflow.ErrorClass {
+	var execErr *tracker.ExecutionError
+	switch {
+	case errors.Is(err, comfy.ErrPromptRejected):
+		return workflow.ClassRejected
+	case errors.Is(err, errSubmit):
+		return workflow.ClassSubmit
+	case errors.Is(err, tracker.ErrBackendLost):
+		return workflow.ClassBackendLost
+	case errors.Is(err, tracker.ErrTimeout):
+		return workflow.ClassTimeout
+	case errors.As(err, &execErr):
+		if execErr.Interrupted {
+			return ""
+		}
+		if strings.Contains(execErr.ExceptionType, "OutOfMemory") || strings.Contains(strings.ToLower(execErr.Message), "out of memory") {
+			return workflow.ClassOOM
+		}
+		return workflow.ClassExecution
+	}
+	return ""
+}
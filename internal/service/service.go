@@ -1,80 +1,312 @@
-package service
-
-import (
-	"context"
-	"fmt"
-
-	"github.com/CP-Payne/comfylite/internal/comfy"
-	"github.com/CP-Payne/comfylite/internal/tracker"
-	"github.com/CP-Payne/comfylite/internal/workflow"
-)
-
-type GenerationResult struct {
-	PromptID string
-	Images   [][]byte
-}
-
-type Service interface {
-	GenerateImage(ctx context.Context, workflowName string, params map[string]any, webhookURL string) (*GenerationResult, error)
-}
-
-type service struct {
-	workflowMgr workflow.Manager
-	comfyClient comfy.Client
-	tracker     tracker.Tracker
-}
-
-func NewService(wm workflow.Manager, cc comfy.Client, tracker tracker.Tracker) Service {
-	return &service{
-		workflowMgr: wm,
-		comfyClient: cc,
-		tracker:     tracker,
-	}
-}
-
-func (s *service) GenerateImage(ctx context.Context, workflowName string, params map[string]any, webhookURL string) (*GenerationResult, error) {
-	finalWorkflow, err := s.workflowMgr.Build(workflowName, params)
-	if err != nil {
-		return nil, fmt.Errorf("failed to build workflow: %w", err)
-	}
-
-	promptID, err := s.comfyClient.Submit(finalWorkflow)
-	if err != nil {
-		return nil, fmt.Errorf("failed to send workflow request: %w", err)
-	}
-
-	imageCount, ok := params["imageCount"].(int)
-	if !ok {
-		fmt.Println("params does not contain imageCount or is not an integer - Defaulting to 1")
-		imageCount = 1
-	}
-
-	// No need to wait for results on the channel, tracker will respond to wehooks on success
-	_, err = s.tracker.Subscribe(promptID, imageCount, webhookURL)
-	if err != nil {
-		return nil, fmt.Errorf("failed to subscribe to tracker using promptID: %s: %w", promptID, err)
-	}
-
-	// select {
-	// case result, ok := <-resultChan:
-	// 	if !ok {
-	// 		return nil, fmt.Errorf("tracker channel closed unexpectedly for promptID: %s", promptID)
-	// 	}
-	// 	if result.Success {
-	// 		return &GenerationResult{
-	// 			PromptID: promptID,
-	// 			Images:   result.Images,
-	// 		}, nil
-	// 	}
-	// 	return nil, fmt.Errorf("prompt failed: %w", result.Error)
-
-	// case <-ctx.Done():
-	// 	return nil, fmt.Errorf("context cancelled while waiting for promptID %s: %w", promptID, ctx.Err())
-
-	// }
-
-	return &GenerationResult{
-		PromptID: promptID,
-	}, nil
-
-}
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/CP-Payne/comfylite/internal/comfy"
+	"github.com/CP-Payne/comfylite/internal/imagestore"
+	"github.com/CP-Payne/comfylite/internal/notifier"
+	"github.com/CP-Payne/comfylite/internal/publicnet"
+	"github.com/CP-Payne/comfylite/internal/store"
+	"github.com/CP-Payne/comfylite/internal/tracker"
+	"github.com/CP-Payne/comfylite/internal/workflow"
+	"github.com/google/uuid"
+)
+
+type GenerationResult struct {
+	PromptID string
+	Images   []tracker.Image
+}
+
+// JobOptions controls how a job is scheduled.
+type JobOptions struct {
+	// Tenant shares ComfyUI fairly with other tenants according to its weight
+	Tenant string
+	// Priority orders the tenant's own jobs, higher runs first
+	Priority int
+}
+
+type Service interface {
+	// Start submits queued jobs to ComfyUI until ctx is cancelled.
+	Start(ctx context.Context)
+	// Recover resumes the jobs a previous run left unfinished. It must be called before the
+	// ComfyUI client is started.
+	Recover()
+	GenerateImage(ctx context.Context, workflowName string, params map[string]any, webhook notifier.Webhook, opts JobOptions) (*GenerationResult, error)
+	GenerateImageSync(ctx context.Context, workflowName string, params map[string]any, webhook notifier.Webhook, opts JobOptions) (*GenerationResult, error)
+	GetJob(ctx context.Context, id string) (*store.Job, error)
+	WatchJob(id string) (updates <-chan tracker.Update, stop func(), ok bool)
+	CancelJob(ctx context.Context, id string) (*store.Job, error)
+	GetImage(ctx context.Context, id string) ([]byte, error)
+	// Workflows returns the names of the workflows that can be generated.
+	Workflows() ([]string, error)
+	DescribeWorkflow(name string) (*workflow.Description, error)
+}
+
+// ErrJobFinished is returned when cancelling a job that already reached a terminal state.
+var ErrJobFinished = errors.New("job already finished")
+
+type service struct {
+	workflowMgr workflow.Manager
+	comfyClient comfy.Client
+	tracker     tracker.Tracker
+	jobs        store.JobStore
+	images      imagestore.ImageStore
+	queue       *jobQueue
+	// imageFetcher is nil unless image URLs are allowed
+	imageFetcher *http.Client
+}
+
+func NewService(wm workflow.Manager, cc comfy.Client, tr tracker.Tracker, jobs store.JobStore, images imagestore.ImageStore, queueOpts QueueOptions, inputOpts InputOptions) Service {
+	queue := newJobQueue(queueOpts, cc, tr, jobs)
+	tr.SetHooks(tracker.Hooks{Retry: queue.retry, Finished: queue.finish})
+
+	s := &service{
+		workflowMgr: wm,
+		comfyClient: cc,
+		tracker:     tr,
+		jobs:        jobs,
+		images:      images,
+		queue:       queue,
+	}
+	if inputOpts.AllowImageURLs {
+		s.imageFetcher = publicnet.NewClient(imageFetchTimeout)
+	}
+	return s
+}
+
+func (s *service) Start(ctx context.Context) {
+	s.queue.run(ctx)
+}
+
+// GenerateImage queues the workflow and returns as soon as the job has been accepted.
+// The result is delivered through the webhook and the job store.
+func (s *service) GenerateImage(ctx context.Context, workflowName string, params map[string]any, webhook notifier.Webhook, opts JobOptions) (*GenerationResult, error) {
+	promptID, _, err := s.submit(ctx, workflowName, params, webhook, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &GenerationResult{
+		PromptID: promptID,
+	}, nil
+}
+
+// GenerateImageSync queues the workflow and blocks until the tracker reports the result or ctx is done.
+// The returned result carries the prompt ID even when an error is returned after submission, so
+// callers can point clients at the job once they stop waiting.
+func (s *service) GenerateImageSync(ctx context.Context, workflowName string, params map[string]any, webhook notifier.Webhook, opts JobOptions) (*GenerationResult, error) {
+	promptID, resultChan, err := s.submit(ctx, workflowName, params, webhook, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case result, ok := <-resultChan:
+		if !ok {
+			return &GenerationResult{PromptID: promptID}, fmt.Errorf("tracker channel closed unexpectedly for promptID: %s", promptID)
+		}
+		if result.Success {
+			return &GenerationResult{
+				PromptID: promptID,
+				Images:   result.Images,
+			}, nil
+		}
+		return &GenerationResult{PromptID: promptID}, fmt.Errorf("prompt failed: %w", result.Error)
+
+	case <-ctx.Done():
+		return &GenerationResult{PromptID: promptID}, fmt.Errorf("context cancelled while waiting for promptID %s: %w", promptID, ctx.Err())
+	}
+}
+
+func (s *service) submit(ctx context.Context, workflowName string, params map[string]any, webhook notifier.Webhook, opts JobOptions) (string, <-chan *tracker.Result, error) {
+	config, err := s.workflowMgr.Config(workflowName)
+	if err != nil {
+		return "", nil, err
+	}
+	if !s.comfyClient.CanRun(config.Requires) {
+		return "", nil, fmt.Errorf("%w: workflow %q requires tags %v", comfy.ErrNoBackend, workflowName, config.Requires)
+	}
+
+	// A fresh seed per request cannot be expressed as a static default in the workflow config
+	if _, ok := config.Mappings["seed"]; ok {
+		if _, set := params["seed"]; !set {
+			params["seed"] = time.Now().UnixNano()
+		}
+	}
+
+	params, err = s.workflowMgr.Resolve(workflowName, params)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := s.uploadInputs(ctx, workflowName, config, params); err != nil {
+		return "", nil, err
+	}
+
+	finalWorkflow, err := s.workflowMgr.Build(workflowName, params)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to build workflow: %w", err)
+	}
+	if err := s.comfyClient.Validate(ctx, finalWorkflow, config.Requires); err != nil {
+		return "", nil, fmt.Errorf("workflow %q does not fit ComfyUI: %w", workflowName, err)
+	}
+
+	results, err := resultsOf(config, finalWorkflow, params)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// The prompt ID is chosen here rather than by ComfyUI so the job can be tracked while it waits in the queue
+	promptID := uuid.New().String()
+
+	var resultChan <-chan *tracker.Result
+	job := &queuedJob{id: promptID, workflow: finalWorkflow, requires: config.Requires, tenant: opts.Tenant, priority: opts.Priority, retry: config.Retry}
+	err = s.queue.enqueue(job, func() error {
+		// The job has to exist before subscribing, the tracker updates it as events are replayed
+		err := s.jobs.Create(&store.Job{
+			ID:         promptID,
+			Status:     store.StatusQueued,
+			Workflow:   workflowName,
+			Params:     params,
+			WebhookURL: webhook.URL,
+			Tenant:     opts.Tenant,
+			Priority:   opts.Priority,
+			CreatedAt:  time.Now(),
+
+			WebhookSecret: webhook.Secret,
+			InlineImages:  webhook.InlineImages,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to record job %s: %w", promptID, err)
+		}
+
+		// The tracker will respond to webhooks on completion, the channel is only read in sync mode
+		resultChan, err = s.tracker.Subscribe(promptID, results, webhook)
+		if err != nil {
+			return fmt.Errorf("failed to subscribe to tracker using promptID: %s: %w", promptID, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	return promptID, resultChan, nil
+}
+
+// resultsOf tells the tracker which images of the built workflow make up the job's result.
+func resultsOf(config *workflow.WorkflowConfig, finalWorkflow []byte, params map[string]any) (tracker.Results, error) {
+	// Most workflows have no imageCount parameter and produce a single image
+	imageCount, ok := intParam(params["imageCount"])
+	if !ok {
+		imageCount = 1
+	}
+	streamNodes, err := workflow.StreamNodes(finalWorkflow)
+	if err != nil {
+		return tracker.Results{}, err
+	}
+	return tracker.Results{Count: imageCount, Nodes: config.Outputs, StreamNodes: streamNodes}, nil
+}
+
+func (s *service) Workflows() ([]string, error) {
+	return s.workflowMgr.List()
+}
+
+func (s *service) DescribeWorkflow(name string) (*workflow.Description, error) {
+	return s.workflowMgr.Describe(name)
+}
+
+// GetJob returns the job with fresh image URLs, as presigned URLs recorded at completion may have expired.
+func (s *service) GetJob(ctx context.Context, id string) (*store.Job, error) {
+	job, err := s.jobs.Get(id)
+	if err != nil || s.images == nil {
+		return job, err
+	}
+
+	for i, image := range job.Images {
+		if image.Key == "" {
+			continue
+		}
+		url, err := s.images.URL(ctx, image.Key)
+		if err != nil {
+			log.Printf("Error getting URL for image %s: %v", image.Key, err)
+			continue
+		}
+		job.Images[i].URL = url
+	}
+	return job, nil
+}
+
+// WatchJob streams live updates for a job that is still being tracked.
+func (s *service) WatchJob(id string) (<-chan tracker.Update, func(), bool) {
+	return s.tracker.Watch(id)
+}
+
+// GetImage reads a stored image by its key.
+func (s *service) GetImage(ctx context.Context, id string) ([]byte, error) {
+	if s.images == nil {
+		return nil, fmt.Errorf("%w: no image store configured", imagestore.ErrNotFound)
+	}
+	return s.images.Get(ctx, id)
+}
+
+// CancelJob removes a queued job from ComfyLite's or ComfyUI's queue or interrupts it if it is
+// running, then finalizes it as cancelled so the webhook fires with that status.
+func (s *service) CancelJob(ctx context.Context, id string) (*store.Job, error) {
+	job, err := s.jobs.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if job.Status.Terminal() {
+		return job, ErrJobFinished
+	}
+
+	if job.Status != store.StatusQueued || !s.queue.remove(id) {
+		if job.Status == store.StatusQueued {
+			if err := s.comfyClient.Dequeue(ctx, id); err != nil {
+				return nil, err
+			}
+		}
+		// The prompt may have started before the tracker heard of it, so it is interrupted unless
+		// the dequeue confirmed it gone. A running job no backend owns cannot be stopped.
+		err := s.comfyClient.Interrupt(ctx, id)
+		if err != nil && !(job.Status == store.StatusQueued && errors.Is(err, comfy.ErrPromptNotOwned)) {
+			return nil, err
+		}
+	}
+
+	if err := s.tracker.Cancel(id); err != nil {
+		// The tracker may have finalized the job in the meantime
+		log.Printf("Cancelling job %s: %v", id, err)
+	}
+
+	job, err = s.jobs.Get(id)
+	if err == nil && job.Status != store.StatusCancelled {
+		return job, ErrJobFinished
+	}
+	return job, err
+}
+
+// intParam reads an integer parameter that may have been decoded from JSON as a json.Number or float64.
+func intParam(v any) (int, bool) {
+	switch n := v.(type) {
+	case int:
+		return n, true
+	case int64:
+		return int(n), true
+	case float64:
+		return int(n), n == float64(int(n))
+	case json.Number:
+		i, err := strconv.Atoi(n.String())
+		return i, err == nil
+	default:
+		return 0, false
+	}
+}
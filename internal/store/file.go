@@ -0,0 +1,112 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// jobFile is the on-disk form of a job, including the fields kept out of API responses.
+type jobFile struct {
+	*Job
+	WebhookSecret string `json:"webhook_secret,omitempty"`
+	InlineImages  bool   `json:"inline_images,omitempty"`
+}
+
+// jobFiles persists jobs as one JSON file each.
+type jobFiles struct {
+	dir string
+}
+
+// NewFileJobStore returns a JobStore that keeps jobs in memory and writes every change to dir, so
+// jobs survive a restart. Jobs already in dir are loaded. Retention works as in NewMemoryJobStore,
+// and dropped jobs are deleted from dir as well.
+func NewFileJobStore(dir string, maxAge time.Duration, maxCount int) (JobStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create job store: %w", err)
+	}
+
+	files := &jobFiles{dir: dir}
+	jobs, err := files.load()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &memoryJobStore{
+		jobs:   make(map[string]*Job, len(jobs)),
+		maxAge: maxAge,
+		maxLen: maxCount,
+		files:  files,
+	}
+	for _, job := range jobs {
+		s.jobs[job.ID] = job
+	}
+	s.prune(time.Now())
+
+	return s, nil
+}
+
+func (f *jobFiles) path(id string) string {
+	return filepath.Join(f.dir, id+".json")
+}
+
+// save writes the job atomically so a crash never leaves a half written file behind.
+func (f *jobFiles) save(job *Job) error {
+	data, err := json.Marshal(jobFile{Job: job, WebhookSecret: job.WebhookSecret, InlineImages: job.InlineImages})
+	if err != nil {
+		return fmt.Errorf("failed to marshal job: %w", err)
+	}
+
+	tmp := f.path(job.ID) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write job: %w", err)
+	}
+	if err := os.Rename(tmp, f.path(job.ID)); err != nil {
+		return fmt.Errorf("failed to write job: %w", err)
+	}
+	return nil
+}
+
+func (f *jobFiles) remove(id string) error {
+	if err := os.Remove(f.path(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove job: %w", err)
+	}
+	return nil
+}
+
+// load returns every job found in the directory.
+func (f *jobFiles) load() ([]*Job, error) {
+	entries, err := os.ReadDir(f.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read job store: %w", err)
+	}
+
+	var jobs []*Job
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(f.dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read job %s: %w", entry.Name(), err)
+		}
+
+		stored := jobFile{Job: &Job{}}
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		// Keep numbers as json.Number so large seeds survive the round trip
+		decoder.UseNumber()
+		if err := decoder.Decode(&stored); err != nil || stored.ID == "" {
+			log.Printf("Skipping unreadable job %s: %v", entry.Name(), err)
+			continue
+		}
+		stored.Job.WebhookSecret, stored.Job.InlineImages = stored.WebhookSecret, stored.InlineImages
+		jobs = append(jobs, stored.Job)
+	}
+	return jobs, nil
+}
@@ -0,0 +1,127 @@
+package store
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFileJobStoreUnfinishedRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	jobs, err := NewFileJobStore(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	created := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	submitted := created.Add(time.Second)
+	for _, job := range []*Job{
+		{ID: "running", Status: StatusRunning, Workflow: "flux", CreatedAt: created.Add(time.Minute)},
+		{ID: "queued", Status: StatusQueued, Workflow: "flux", CreatedAt: created},
+		{ID: "done", Status: StatusSucceeded, Workflow: "flux", CreatedAt: created},
+	} {
+		if err := jobs.Create(job); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = jobs.Update("running", func(job *Job) {
+		job.Params = map[string]any{"prompt": "a cat", "seed": uint64(12345678901234567890)}
+		job.WebhookURL, job.WebhookSecret, job.InlineImages = "https://example.com/hook", "secret", true
+		job.Tenant, job.Priority = "acme", 5
+		job.Attempts = []Attempt{{Number: 1, Backend: "http://comfy-1:8188", SubmittedAt: submitted}}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := jobs.SetProgress("running", &Progress{Node: "3", Value: 4, Max: 20}); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := NewFileJobStore(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unfinished := reopened.Unfinished()
+	if len(unfinished) != 2 || unfinished[0].ID != "queued" || unfinished[1].ID != "running" {
+		t.Fatalf("Unfinished() = %v, want queued then running", unfinished)
+	}
+
+	got := unfinished[1]
+	want := &Job{
+		ID:            "running",
+		Status:        StatusRunning,
+		Workflow:      "flux",
+		Params:        map[string]any{"prompt": "a cat", "seed": json.Number("12345678901234567890")},
+		WebhookURL:    "https://example.com/hook",
+		Tenant:        "acme",
+		Priority:      5,
+		CreatedAt:     created.Add(time.Minute),
+		Attempts:      []Attempt{{Number: 1, Backend: "http://comfy-1:8188", SubmittedAt: submitted}},
+		WebhookSecret: "secret",
+		InlineImages:  true,
+	}
+	// Progress is not persisted, the recovered job is the one of the last Update
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("reloaded job = %+v, want %+v", got, want)
+	}
+
+	if _, err := reopened.Get("done"); err != nil {
+		t.Errorf("Get(done) = %v, finished jobs are reloaded as well", err)
+	}
+}
+
+func TestFileJobStoreSetProgressDoesNotWrite(t *testing.T) {
+	dir := t.TempDir()
+	jobs, err := NewFileJobStore(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := jobs.Create(&Job{ID: "job", Status: StatusRunning}); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "job.json")
+	before, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := jobs.SetProgress("job", &Progress{Value: 1, Max: 20}); err != nil {
+		t.Fatal(err)
+	}
+	after, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(before) != string(after) {
+		t.Errorf("SetProgress rewrote the job file: %s", after)
+	}
+
+	job, err := jobs.Get("job")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Progress == nil || job.Progress.Value != 1 {
+		t.Errorf("Get() progress = %+v, want the value set in memory", job.Progress)
+	}
+
+	if err := jobs.SetProgress("missing", &Progress{}); err == nil {
+		t.Error("SetProgress(missing) succeeded, want ErrJobNotFound")
+	}
+}
+
+func TestFileJobStoreSkipsUnreadableFiles(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "broken.json"), []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	jobs, err := NewFileJobStore(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unfinished := jobs.Unfinished(); len(unfinished) != 0 {
+		t.Errorf("Unfinished() = %v, want none", unfinished)
+	}
+}
@@ -0,0 +1,101 @@
+package store
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrJobNotFound is returned when a job does not exist or has been pruned by retention.
+var ErrJobNotFound = errors.New("job not found")
+
+type JobStatus string
+
+const (
+	StatusQueued    JobStatus = "queued"
+	StatusRunning   JobStatus = "running"
+	StatusSucceeded JobStatus = "succeeded"
+	StatusFailed    JobStatus = "failed"
+	StatusCancelled JobStatus = "cancelled"
+)
+
+// Terminal reports whether no further updates are expected for a job in this status.
+func (s JobStatus) Terminal() bool {
+	return s == StatusSucceeded || s == StatusFailed || s == StatusCancelled
+}
+
+type Progress struct {
+	Node  string `json:"node,omitempty"`
+	Value int    `json:"value"`
+	Max   int    `json:"max"`
+}
+
+type JobError struct {
+	Message       string   `json:"message"`
+	NodeID        string   `json:"node_id,omitempty"`
+	NodeType      string   `json:"node_type,omitempty"`
+	ExceptionType string   `json:"exception_type,omitempty"`
+	Traceback     []string `json:"traceback,omitempty"`
+	Interrupted   bool     `json:"interrupted,omitempty"`
+}
+
+// ImageRef points at one of the images a job produced. Key and the fields after it are only set
+// when the image was written to an image store.
+type ImageRef struct {
+	Index       int    `json:"index"`
+	Size        int    `json:"size"`
+	Key         string `json:"key,omitempty"`
+	URL         string `json:"url,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Width       int    `json:"width,omitempty"`
+	Height      int    `json:"height,omitempty"`
+	SHA256      string `json:"sha256,omitempty"`
+}
+
+// Attempt is one submission of a job to ComfyUI. Jobs that fail with a retryable error are
+// submitted again under the same ID.
+type Attempt struct {
+	Number      int        `json:"number"`
+	Backend     string     `json:"backend,omitempty"`
+	SubmittedAt time.Time  `json:"submitted_at"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	// ErrorClass is the retry class of Error, such as "timeout" or "oom"
+	ErrorClass string `json:"error_class,omitempty"`
+}
+
+type Job struct {
+	ID         string         `json:"id"`
+	Status     JobStatus      `json:"status"`
+	Workflow   string         `json:"workflow"`
+	Params     map[string]any `json:"params,omitempty"`
+	WebhookURL string         `json:"webhook_url,omitempty"`
+	Tenant     string         `json:"tenant,omitempty"`
+	Priority   int            `json:"priority,omitempty"`
+	CreatedAt  time.Time      `json:"created_at"`
+	StartedAt  *time.Time     `json:"started_at,omitempty"`
+	FinishedAt *time.Time     `json:"finished_at,omitempty"`
+	Progress   *Progress      `json:"progress,omitempty"`
+	Error      *JobError      `json:"error,omitempty"`
+	Images     []ImageRef     `json:"images,omitempty"`
+	Attempts   []Attempt      `json:"attempts,omitempty"`
+
+	// WebhookSecret and InlineImages complete the webhook so it can be restored after a restart.
+	// They are kept out of API responses.
+	WebhookSecret string `json:"-"`
+	InlineImages  bool   `json:"-"`
+}
+
+// JobStore keeps the state of generation jobs so it can be queried after the tracker is done with them.
+type JobStore interface {
+	Create(job *Job) error
+	// Get returns a copy of the job that is safe to use without further locking.
+	Get(id string) (*Job, error)
+	// Update applies fn to the stored job under the store's lock.
+	Update(id string, fn func(job *Job)) error
+	// SetProgress records how far a running job is. Unlike Update it is not persisted: progress
+	// changes with every sampler step and is reset when a job is recovered. The next Update writes
+	// it along with the rest of the job.
+	SetProgress(id string, progress *Progress) error
+	// Unfinished returns copies of the jobs that are still queued or running, oldest first.
+	Unfinished() []*Job
+}
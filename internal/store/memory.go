@@ -0,0 +1,168 @@
+package store
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+type memoryJobStore struct {
+	jobs   map[string]*Job
+	mux    sync.RWMutex
+	maxAge time.Duration
+	maxLen int
+	// files is nil when jobs are only kept in memory
+	files *jobFiles
+}
+
+// NewMemoryJobStore returns a JobStore that keeps jobs in memory. Finished jobs are dropped once
+// they are older than maxAge, or oldest first once more than maxCount jobs are stored.
+// A zero maxAge or maxCount disables that limit.
+func NewMemoryJobStore(maxAge time.Duration, maxCount int) JobStore {
+	return &memoryJobStore{
+		jobs:   make(map[string]*Job),
+		maxAge: maxAge,
+		maxLen: maxCount,
+	}
+}
+
+func (s *memoryJobStore) Create(job *Job) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if _, exists := s.jobs[job.ID]; exists {
+		return fmt.Errorf("job %s already exists", job.ID)
+	}
+	s.jobs[job.ID] = cloneJob(job)
+	s.save(job)
+	s.prune(time.Now())
+
+	return nil
+}
+
+func (s *memoryJobStore) Get(id string) (*Job, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	job, ok := s.jobs[id]
+	if !ok || s.expired(job, time.Now()) {
+		return nil, fmt.Errorf("%w: %s", ErrJobNotFound, id)
+	}
+	return cloneJob(job), nil
+}
+
+func (s *memoryJobStore) Update(id string, fn func(job *Job)) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	job, ok := s.jobs[id]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrJobNotFound, id)
+	}
+	wasTerminal := job.Status.Terminal()
+	fn(job)
+	s.save(job)
+	if !wasTerminal && job.Status.Terminal() {
+		s.prune(time.Now())
+	}
+
+	return nil
+}
+
+func (s *memoryJobStore) SetProgress(id string, progress *Progress) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	job, ok := s.jobs[id]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrJobNotFound, id)
+	}
+	job.Progress = progress
+	return nil
+}
+
+func (s *memoryJobStore) Unfinished() []*Job {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	var jobs []*Job
+	for _, job := range s.jobs {
+		if !job.Status.Terminal() {
+			jobs = append(jobs, cloneJob(job))
+		}
+	}
+	slices.SortFunc(jobs, func(a, b *Job) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	return jobs
+}
+
+// save persists a job if the store is backed by files. A failed write is logged rather than
+// returned, the job is still up to date in memory.
+func (s *memoryJobStore) save(job *Job) {
+	if s.files == nil {
+		return
+	}
+	if err := s.files.save(job); err != nil {
+		log.Printf("Error persisting job %s: %v", job.ID, err)
+	}
+}
+
+// delete drops a job from memory and disk.
+func (s *memoryJobStore) delete(id string) {
+	delete(s.jobs, id)
+	if s.files == nil {
+		return
+	}
+	if err := s.files.remove(id); err != nil {
+		log.Printf("Error removing job %s: %v", id, err)
+	}
+}
+
+func (s *memoryJobStore) expired(job *Job, now time.Time) bool {
+	return s.maxAge > 0 && job.FinishedAt != nil && now.Sub(*job.FinishedAt) > s.maxAge
+}
+
+// prune applies the retention limits. Jobs that are still queued or running are never dropped.
+func (s *memoryJobStore) prune(now time.Time) {
+	var finished []*Job
+	for id, job := range s.jobs {
+		if !job.Status.Terminal() || job.FinishedAt == nil {
+			continue
+		}
+		if s.expired(job, now) {
+			s.delete(id)
+			continue
+		}
+		finished = append(finished, job)
+	}
+
+	if s.maxLen <= 0 || len(s.jobs) <= s.maxLen {
+		return
+	}
+
+	slices.SortFunc(finished, func(a, b *Job) int { return a.FinishedAt.Compare(*b.FinishedAt) })
+	for _, job := range finished {
+		if len(s.jobs) <= s.maxLen {
+			break
+		}
+		s.delete(job.ID)
+	}
+}
+
+func cloneJob(job *Job) *Job {
+	clone := *job
+	clone.Params = maps.Clone(job.Params)
+	clone.Images = slices.Clone(job.Images)
+	clone.Attempts = slices.Clone(job.Attempts)
+	if job.Progress != nil {
+		progress := *job.Progress
+		clone.Progress = &progress
+	}
+	if job.Error != nil {
+		jobErr := *job.Error
+		clone.Error = &jobErr
+	}
+	return &clone
+}
@@ -1,194 +1,624 @@
-package tracker
-
-import (
-	"context"
-	"encoding/base64"
-	"fmt"
-	"log"
-	"sync"
-	"time"
-
-	"github.com/CP-Payne/comfylite/internal/notifier"
-)
-
-type Tracker interface {
-	Start(ctx context.Context, eventChan <-chan Event)
-	Subscribe(promptID string, imagesExpected int, webhookURL string) (<-chan *Result, error)
-}
-
-type tracker struct {
-	currentPrompt *PromptState
-	allPrompts    map[string]*PromptState
-	promptsMux    sync.RWMutex
-	notifier      notifier.Notifier
-}
-
-func New(notifier notifier.Notifier) Tracker {
-	return &tracker{
-		allPrompts: make(map[string]*PromptState),
-		notifier:   notifier,
-	}
-}
-
-func (t *tracker) Start(ctx context.Context, eventChan <-chan Event) {
-	log.Println("Tracker service started.")
-
-	timeout := time.NewTimer(30 * time.Second)
-	timeout.Stop()
-
-	for {
-		select {
-		case <-ctx.Done():
-			log.Println("Tracker service shutting down.")
-			return
-		case event, ok := <-eventChan:
-			if !ok {
-				log.Println("Tracker event channel closed.")
-				t.finalizePrompt(t.currentPrompt, "channel closed")
-				return
-			}
-
-			// Drain the remaining timeout if it has not stopped successfully
-			// Note: any event received by this eventChan is a sign of life (heartbeat) (such as the progress and executing event)
-			// and should reset the timer
-			if !timeout.Stop() {
-				select {
-				case <-timeout.C:
-				default:
-				}
-			}
-			t.processEvent(event)
-			if t.currentPrompt != nil {
-				timeout.Reset(30 * time.Second)
-			}
-
-		case <-timeout.C:
-			log.Println("Tracker timed out waiting for new events. Finalizing last known prompt.")
-			t.finalizePrompt(t.currentPrompt, "tracker timed out")
-		}
-	}
-}
-
-func (t *tracker) processEvent(event Event) {
-	t.promptsMux.Lock()
-	defer t.promptsMux.Unlock()
-
-	switch event.Type {
-	case EventExecutionStart:
-
-		if t.currentPrompt != nil {
-			t.finalizePrompt(t.currentPrompt, "new prompt started")
-		}
-
-		prompt, ok := t.allPrompts[event.PromptID]
-		if !ok {
-			log.Printf("Error: Received start event for untracked prompt ID %s", event.PromptID)
-			return
-		}
-
-		t.currentPrompt = prompt
-		log.Printf("Tracking started for new prompt: %s", t.currentPrompt.ID)
-
-	case EventImageReceived:
-		if t.currentPrompt == nil {
-			log.Println("Warning: Received binary data with no active prompt.")
-			return
-		}
-		if binaryData, ok := event.Data.([]byte); ok {
-			t.currentPrompt.ImagesReceived = append(t.currentPrompt.ImagesReceived, binaryData)
-		}
-		t.tryFinalizeOnSuccess(t.currentPrompt)
-	case EventExecutionFinished:
-		if t.currentPrompt == nil {
-			log.Println("Warning: Received finished event with no active prompt.")
-			return
-		}
-		t.currentPrompt.ExecutionFinished = true
-		t.tryFinalizeOnSuccess(t.currentPrompt)
-
-	}
-}
-
-func (t *tracker) tryFinalizeOnSuccess(prompt *PromptState) {
-	if prompt == nil {
-		return
-	}
-
-	if prompt.ExecutionFinished && len(prompt.ImagesReceived) == prompt.ImagesExpected {
-		t.finalizePrompt(prompt, "all images and finished signal received")
-	}
-}
-
-func (t *tracker) finalizePrompt(prompt *PromptState, reason string) {
-	if _, exist := t.allPrompts[prompt.ID]; !exist {
-		return
-	}
-
-	log.Printf("Finalizing prompt. Reason: %s\n", reason)
-
-	var payload notifier.WebhookPayload
-
-	if prompt.ExecutionFinished && len(prompt.ImagesReceived) == prompt.ImagesExpected {
-		log.Printf("Prompt %s finished successfully.", prompt.ID)
-
-		// Encode binary images before sending
-		var encodedImages []string
-		for _, image := range prompt.ImagesReceived {
-			encodedImages = append(encodedImages, base64.StdEncoding.EncodeToString(image))
-		}
-
-		payload = notifier.WebhookPayload{
-			Status:   "success",
-			PromptID: prompt.ID,
-			Images:   encodedImages,
-		}
-
-		// Still send the result to the channel for incase any consumers wants to wait for the success result
-		prompt.ResultChan <- &Result{Success: true, Images: prompt.ImagesReceived}
-	} else {
-		err := fmt.Errorf("prompt failed validation: expected %d images, got %d. finish_signal: %t", prompt.ImagesExpected, len(prompt.ImagesReceived), prompt.ExecutionFinished)
-		log.Printf("Prompt %s failed: %v", prompt.ID, err)
-
-		payload = notifier.WebhookPayload{
-			Status:   "failure",
-			PromptID: prompt.ID,
-			Error:    err.Error(),
-		}
-
-		prompt.ResultChan <- &Result{Success: false, Error: err}
-	}
-
-	if prompt.WebhookURL != "" {
-		if err := t.notifier.Notify(prompt.WebhookURL, payload); err != nil {
-			fmt.Printf("Error queueing webhook notification for prompt %s: %v\n", prompt.ID, err)
-		}
-	}
-
-	close(prompt.ResultChan)
-	delete(t.allPrompts, prompt.ID)
-
-	if t.currentPrompt != nil && t.currentPrompt.ID == prompt.ID {
-		t.currentPrompt = nil
-	}
-}
-
-func (t *tracker) Subscribe(promptID string, imagesExpected int, webhookURL string) (<-chan *Result, error) {
-	t.promptsMux.Lock()
-	defer t.promptsMux.Unlock()
-
-	if _, exists := t.allPrompts[promptID]; exists {
-		return nil, fmt.Errorf("prompt ID %s is already being tracked", promptID)
-	}
-
-	newState := &PromptState{
-		ID:             promptID,
-		ImagesExpected: imagesExpected,
-		ImagesReceived: make([][]byte, 0, imagesExpected),
-		ResultChan:     make(chan *Result, 1),
-		WebhookURL:     webhookURL,
-	}
-
-	t.allPrompts[promptID] = newState
-
-	return newState.ResultChan, nil
-}
+package tracker
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CP-Payne/comfylite/internal/imagestore"
+	"github.com/CP-Payne/comfylite/internal/notifier"
+	"github.com/CP-Payne/comfylite/internal/store"
+)
+
+const (
+	// promptTimeout is how long a started prompt may go without any event before it is failed
+	promptTimeout = 30 * time.Second
+	// pendingTTL is how long events for not yet subscribed prompts are kept around
+	pendingTTL    = time.Minute
+	sweepInterval = 5 * time.Second
+	// storeTimeout bounds writing a prompt's images to the image store
+	storeTimeout = 2 * time.Minute
+)
+
+type Tracker interface {
+	Start(ctx context.Context, eventChan <-chan Event)
+	// Subscribe tracks a prompt until it has finished. Images that are not part of its results are
+	// published to watchers as previews.
+	Subscribe(promptID string, results Results, webhook notifier.Webhook) (<-chan *Result, error)
+	// Watch streams live updates for a tracked prompt. The channel is closed after the final
+	// UpdateResult or when stop is called. ok is false if the prompt is not being tracked.
+	Watch(promptID string) (updates <-chan Update, stop func(), ok bool)
+	// Cancel finalizes a tracked prompt as cancelled. It does not stop the prompt in ComfyUI.
+	Cancel(promptID string) error
+	// Fail finalizes a tracked prompt as failed, for errors that happen outside of ComfyUI such as
+	// a rejected submission.
+	Fail(promptID string, err error) error
+	// Resubmitted is called when a prompt that is being retried is about to be submitted again, so
+	// the events of the new attempt are no longer ignored.
+	Resubmitted(promptID string)
+	SetHooks(hooks Hooks)
+}
+
+// Hooks let the owner of the tracker react to the end of a prompt's attempts. They are called with
+// the tracker's lock held and must not call back into the tracker.
+type Hooks struct {
+	// Retry is asked whether a failed prompt gets another attempt. When it returns true the prompt
+	// stays tracked with its progress reset, and is expected to be submitted again.
+	Retry func(promptID string, err error) bool
+	// Finished is called once a prompt has been finalized, with a nil error on success.
+	Finished func(promptID string, err error)
+}
+
+// pendingEvent is an event that arrived before its prompt was subscribed. ComfyUI can start
+// executing a prompt before the /prompt response has been handled, so these are replayed on Subscribe.
+type pendingEvent struct {
+	event      Event
+	receivedAt time.Time
+}
+
+type tracker struct {
+	allPrompts map[string]*PromptState
+	pending    map[string][]pendingEvent
+	watchers   map[string][]chan Update
+	promptsMux sync.Mutex
+	notifier   notifier.Notifier
+	jobs       store.JobStore
+	hooks      Hooks
+	// images is nil when no image store is configured, results are then always sent inline
+	images imagestore.ImageStore
+}
+
+func New(notifier notifier.Notifier, jobs store.JobStore, images imagestore.ImageStore) Tracker {
+	return &tracker{
+		allPrompts: make(map[string]*PromptState),
+		pending:    make(map[string][]pendingEvent),
+		watchers:   make(map[string][]chan Update),
+		notifier:   notifier,
+		jobs:       jobs,
+		images:     images,
+	}
+}
+
+func (t *tracker) SetHooks(hooks Hooks) {
+	t.promptsMux.Lock()
+	defer t.promptsMux.Unlock()
+
+	t.hooks = hooks
+}
+
+func (t *tracker) Start(ctx context.Context, eventChan <-chan Event) {
+	log.Println("Tracker service started.")
+
+	sweep := time.NewTicker(sweepInterval)
+	defer sweep.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("Tracker service shutting down.")
+			return
+		case event, ok := <-eventChan:
+			if !ok {
+				log.Println("Tracker event channel closed.")
+				t.finalizeStarted("channel closed")
+				return
+			}
+			t.processEvent(event)
+
+		case now := <-sweep.C:
+			t.sweep(now)
+		}
+	}
+}
+
+// sweep fails started prompts that have stopped receiving events and drops stale pending events.
+// Note: any event received for a prompt is a sign of life (heartbeat), such as the progress and executing events.
+func (t *tracker) sweep(now time.Time) {
+	t.promptsMux.Lock()
+	defer t.promptsMux.Unlock()
+
+	for _, prompt := range t.allPrompts {
+		if prompt.Started && !prompt.Storing && now.Sub(prompt.LastActivity) > promptTimeout {
+			log.Printf("Tracker timed out waiting for new events for prompt %s.", prompt.ID)
+			prompt.Err = fmt.Errorf("%w: no events for %s", ErrTimeout, promptTimeout)
+			t.finalizePrompt(prompt, "tracker timed out")
+		}
+	}
+
+	for promptID, events := range t.pending {
+		if now.Sub(events[len(events)-1].receivedAt) > pendingTTL {
+			delete(t.pending, promptID)
+		}
+	}
+}
+
+func (t *tracker) finalizeStarted(reason string) {
+	t.promptsMux.Lock()
+	defer t.promptsMux.Unlock()
+
+	for _, prompt := range t.allPrompts {
+		if prompt.Started && !prompt.Storing {
+			t.finalizePrompt(prompt, reason)
+		}
+	}
+}
+
+func (t *tracker) processEvent(event Event) {
+	t.promptsMux.Lock()
+	defer t.promptsMux.Unlock()
+
+	if event.PromptID == "" {
+		log.Printf("Warning: Received %s event without a prompt ID.", event.Type)
+		return
+	}
+
+	prompt, ok := t.allPrompts[event.PromptID]
+	if !ok {
+		t.pending[event.PromptID] = append(t.pending[event.PromptID], pendingEvent{event: event, receivedAt: time.Now()})
+		return
+	}
+	if prompt.Storing || prompt.Retrying {
+		return
+	}
+
+	t.applyEvent(prompt, event)
+}
+
+func (t *tracker) applyEvent(prompt *PromptState, event Event) {
+	prompt.LastActivity = time.Now()
+
+	switch event.Type {
+	case EventExecutionStart:
+		t.markStarted(prompt)
+		log.Printf("Tracking started for prompt: %s", prompt.ID)
+
+	case EventExecuting:
+		t.markStarted(prompt)
+		t.setProgress(prompt.ID, &store.Progress{Node: event.Node})
+		if event.Node != "" {
+			t.publish(prompt.ID, Update{Type: UpdateExecuting, PromptID: prompt.ID, Node: event.Node})
+		}
+
+	case EventProgress:
+		t.markStarted(prompt)
+		progress, _ := event.Data.(Progress)
+		t.setProgress(prompt.ID, &store.Progress{Node: event.Node, Value: progress.Value, Max: progress.Max})
+		update := Update{Type: UpdateProgress, PromptID: prompt.ID, Node: event.Node, Value: progress.Value, Max: progress.Max}
+		if progress.Max > 0 {
+			update.Percent = float64(progress.Value) * 100 / float64(progress.Max)
+		}
+		t.publish(prompt.ID, update)
+
+	case EventImageReceived:
+		switch image := event.Data.(type) {
+		case Image:
+			if isResult(prompt.Results, event.Node, true, false) {
+				prompt.ImagesReceived = append(prompt.ImagesReceived, image)
+				break
+			}
+			t.publish(prompt.ID, Update{
+				Type:        UpdatePreview,
+				PromptID:    prompt.ID,
+				Node:        event.Node,
+				Image:       base64.StdEncoding.EncodeToString(image.Data),
+				ContentType: image.ContentType,
+			})
+		case OutputImage:
+			if isResult(prompt.Results, event.Node, false, image.Temporary) {
+				prompt.ImagesReceived = append(prompt.ImagesReceived, image.Image)
+			}
+		}
+
+	case EventExecutionFinished:
+		// ComfyUI sends every output before the success event, so nothing more is coming
+		prompt.ExecutionFinished = true
+		t.finalizePrompt(prompt, "finished signal received")
+
+	case EventJobFailed, EventExecutionInterrupted:
+		if execErr, ok := event.Data.(*ExecutionError); ok {
+			prompt.Err = execErr
+		} else if err, ok := event.Data.(error); ok {
+			prompt.Err = err
+		} else {
+			prompt.Err = fmt.Errorf("%v", event.Data)
+		}
+		t.finalizePrompt(prompt, "execution failed")
+
+	case EventExecutionCached:
+		if nodes, ok := event.Data.([]string); ok {
+			prompt.CachedNodes = append(prompt.CachedNodes, nodes...)
+		}
+	}
+}
+
+// isResult reports whether an image of node belongs to the result rather than being a preview.
+// streamed is set for images sent over the websocket, temporary for files in ComfyUI's temp directory.
+func isResult(results Results, node string, streamed, temporary bool) bool {
+	switch {
+	case len(results.Nodes) > 0:
+		return slices.Contains(results.Nodes, node)
+	case streamed:
+		return slices.Contains(results.StreamNodes, node)
+	default:
+		return !temporary
+	}
+}
+
+// cachedResultNodes returns the result nodes ComfyUI skipped because their output was cached.
+// Cached save nodes are reported with their files from /history, but streamed images are not kept,
+// so a cached streaming node sends nothing.
+func cachedResultNodes(prompt *PromptState) []string {
+	var nodes []string
+	for _, node := range prompt.CachedNodes {
+		if slices.Contains(prompt.Results.Nodes, node) || slices.Contains(prompt.Results.StreamNodes, node) {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// markStarted flags the prompt as executing. Executing and progress events also count, as they can
+// be replayed without the execution_start that preceded them.
+func (t *tracker) markStarted(prompt *PromptState) {
+	if prompt.Started {
+		return
+	}
+	prompt.Started = true
+
+	now := time.Now()
+	t.updateJob(prompt.ID, func(job *store.Job) {
+		job.Status = store.StatusRunning
+		job.StartedAt = &now
+	})
+	t.publish(prompt.ID, Update{Type: UpdateStarted, PromptID: prompt.ID})
+}
+
+// publish sends an update to every watcher of the prompt without blocking. Slow watchers miss
+// intermediate updates rather than stalling the tracker. Must be called with promptsMux held.
+func (t *tracker) publish(promptID string, update Update) {
+	for _, ch := range t.watchers[promptID] {
+		select {
+		case ch <- update:
+		default:
+		}
+	}
+}
+
+func (t *tracker) Watch(promptID string) (<-chan Update, func(), bool) {
+	t.promptsMux.Lock()
+	defer t.promptsMux.Unlock()
+
+	if _, tracked := t.allPrompts[promptID]; !tracked {
+		return nil, func() {}, false
+	}
+
+	ch := make(chan Update, 32)
+	t.watchers[promptID] = append(t.watchers[promptID], ch)
+
+	stop := func() {
+		t.promptsMux.Lock()
+		defer t.promptsMux.Unlock()
+
+		// The channel is gone already if the prompt was finalized
+		watchers := t.watchers[promptID]
+		for i, watcher := range watchers {
+			if watcher == ch {
+				t.watchers[promptID] = append(watchers[:i], watchers[i+1:]...)
+				close(ch)
+				break
+			}
+		}
+		if len(t.watchers[promptID]) == 0 {
+			delete(t.watchers, promptID)
+		}
+	}
+
+	return ch, stop, true
+}
+
+func (t *tracker) updateJob(promptID string, fn func(job *store.Job)) {
+	if err := t.jobs.Update(promptID, fn); err != nil {
+		log.Printf("Error updating job %s: %v", promptID, err)
+	}
+}
+
+// finalizePrompt must be called with promptsMux held.
+// setProgress records progress in memory only, it arrives with every step of the prompt.
+func (t *tracker) setProgress(promptID string, progress *store.Progress) {
+	if err := t.jobs.SetProgress(promptID, progress); err != nil {
+		log.Printf("Error updating progress of job %s: %v", promptID, err)
+	}
+}
+
+func (t *tracker) finalizePrompt(prompt *PromptState, reason string) {
+	if prompt == nil {
+		return
+	}
+	if _, exist := t.allPrompts[prompt.ID]; !exist {
+		return
+	}
+
+	log.Printf("Finalizing prompt %s. Reason: %s\n", prompt.ID, reason)
+
+	var payload notifier.WebhookPayload
+	finishedAt := time.Now()
+
+	if prompt.Cancelled {
+		log.Printf("Prompt %s was cancelled.", prompt.ID)
+
+		payload = notifier.WebhookPayload{
+			Status:   "cancelled",
+			PromptID: prompt.ID,
+			Error:    ErrCancelled.Error(),
+		}
+
+		t.updateJob(prompt.ID, func(job *store.Job) {
+			job.Status = store.StatusCancelled
+			job.FinishedAt = &finishedAt
+		})
+
+		prompt.ResultChan <- &Result{Success: false, Error: ErrCancelled}
+		t.finished(prompt.ID, ErrCancelled)
+	} else if prompt.Err == nil && prompt.ExecutionFinished && len(prompt.ImagesReceived) >= prompt.Results.Count {
+		if t.images != nil && prompt.Outputs == nil {
+			// Uploads can be slow, so they run without holding up other prompts. The prompt is
+			// finalized again once its images are stored.
+			prompt.Storing = true
+			go t.storeImages(prompt, reason)
+			return
+		}
+
+		log.Printf("Prompt %s finished successfully.", prompt.ID)
+
+		payload = notifier.WebhookPayload{
+			Status:   "success",
+			PromptID: prompt.ID,
+			Outputs:  prompt.Outputs,
+		}
+
+		// Without an image store inline images are the only way to deliver the result
+		if t.images == nil || prompt.Webhook.InlineImages {
+			for _, image := range prompt.ImagesReceived {
+				payload.Images = append(payload.Images, base64.StdEncoding.EncodeToString(image.Data))
+			}
+		}
+
+		imageRefs := make([]store.ImageRef, 0, len(prompt.ImagesReceived))
+		for i, image := range prompt.ImagesReceived {
+			ref := store.ImageRef{Index: i, Size: len(image.Data), ContentType: image.ContentType}
+			if i < len(prompt.Outputs) {
+				output := prompt.Outputs[i]
+				ref.Key = prompt.Keys[i]
+				ref.URL = output.URL
+				ref.ContentType = output.ContentType
+				ref.Width, ref.Height = output.Width, output.Height
+				ref.SHA256 = output.SHA256
+			}
+			imageRefs = append(imageRefs, ref)
+		}
+		t.updateJob(prompt.ID, func(job *store.Job) {
+			job.Status = store.StatusSucceeded
+			job.FinishedAt = &finishedAt
+			job.Images = imageRefs
+		})
+
+		// Still send the result to the channel for incase any consumers wants to wait for the success result
+		prompt.ResultChan <- &Result{Success: true, Images: prompt.ImagesReceived}
+		t.finished(prompt.ID, nil)
+	} else {
+		err := prompt.Err
+		if err == nil {
+			err = fmt.Errorf("prompt failed validation: expected at least %d images, got %d. finish_signal: %t", prompt.Results.Count, len(prompt.ImagesReceived), prompt.ExecutionFinished)
+			if cached := cachedResultNodes(prompt); prompt.ExecutionFinished && len(cached) > 0 {
+				err = fmt.Errorf("%w. ComfyUI served result nodes %s from its cache", err, strings.Join(cached, ", "))
+			}
+		}
+
+		if t.hooks.Retry != nil && t.hooks.Retry(prompt.ID, err) {
+			log.Printf("Prompt %s failed and will be retried: %v", prompt.ID, err)
+			t.resetPrompt(prompt)
+			t.publish(prompt.ID, Update{Type: UpdateRetrying, PromptID: prompt.ID, Error: err.Error()})
+			return
+		}
+		log.Printf("Prompt %s failed: %v", prompt.ID, err)
+
+		payload = notifier.WebhookPayload{
+			Status:   "failure",
+			PromptID: prompt.ID,
+			Error:    err.Error(),
+		}
+
+		jobErr := &store.JobError{Message: err.Error()}
+		var execErr *ExecutionError
+		if errors.As(err, &execErr) {
+			payload.ErrorDetails = &notifier.ErrorDetails{
+				NodeID:        execErr.NodeID,
+				NodeType:      execErr.NodeType,
+				ExceptionType: execErr.ExceptionType,
+				Message:       execErr.Message,
+				Traceback:     execErr.Traceback,
+				Interrupted:   execErr.Interrupted,
+			}
+			jobErr = &store.JobError{
+				Message:       err.Error(),
+				NodeID:        execErr.NodeID,
+				NodeType:      execErr.NodeType,
+				ExceptionType: execErr.ExceptionType,
+				Traceback:     execErr.Traceback,
+				Interrupted:   execErr.Interrupted,
+			}
+		}
+		t.updateJob(prompt.ID, func(job *store.Job) {
+			job.Status = store.StatusFailed
+			job.FinishedAt = &finishedAt
+			job.Error = jobErr
+		})
+
+		prompt.ResultChan <- &Result{Success: false, Error: err}
+		t.finished(prompt.ID, err)
+	}
+
+	if prompt.Webhook.URL != "" {
+		if err := t.notifier.Notify(prompt.Webhook, payload); err != nil {
+			fmt.Printf("Error queueing webhook notification for prompt %s: %v\n", prompt.ID, err)
+		}
+	}
+
+	close(prompt.ResultChan)
+	delete(t.allPrompts, prompt.ID)
+
+	// The final update is sent blocking-free as well, watchers re-read the job when their channel closes
+	t.publish(prompt.ID, Update{Type: UpdateResult, PromptID: prompt.ID})
+	for _, ch := range t.watchers[prompt.ID] {
+		close(ch)
+	}
+	delete(t.watchers, prompt.ID)
+}
+
+// resetPrompt clears the state of a failed attempt so the prompt can be tracked again.
+func (t *tracker) resetPrompt(prompt *PromptState) {
+	prompt.ImagesReceived = prompt.ImagesReceived[:0]
+	prompt.ExecutionFinished = false
+	prompt.Started = false
+	prompt.LastActivity = time.Now()
+	prompt.Err = nil
+	prompt.CachedNodes = nil
+	prompt.Retrying = true
+}
+
+func (t *tracker) finished(promptID string, err error) {
+	if t.hooks.Finished != nil {
+		t.hooks.Finished(promptID, err)
+	}
+}
+
+// storeImages writes a finished prompt's images to the image store and finalizes it. A failed
+// upload fails the prompt, as the images could not be delivered otherwise.
+func (t *tracker) storeImages(prompt *PromptState, reason string) {
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+
+	outputs := make([]notifier.ImageOutput, 0, len(prompt.ImagesReceived))
+	keys := make([]string, 0, len(prompt.ImagesReceived))
+	var err error
+	for i, image := range prompt.ImagesReceived {
+		info := imagestore.Describe("", image.Data)
+		if image.ContentType != "" {
+			info.ContentType = image.ContentType
+		}
+		// Keys are flat so they can be used as the image ID in /images/{id}
+		key := fmt.Sprintf("%s-%d%s", prompt.ID, i, imagestore.Extension(info.ContentType))
+
+		if err = t.images.Put(ctx, key, image.Data, info.ContentType); err != nil {
+			err = fmt.Errorf("failed to store image %d: %w", i, err)
+			break
+		}
+		var url string
+		if url, err = t.images.URL(ctx, key); err != nil {
+			err = fmt.Errorf("failed to get URL for image %d: %w", i, err)
+			break
+		}
+
+		keys = append(keys, key)
+		outputs = append(outputs, notifier.ImageOutput{
+			Index:       i,
+			URL:         url,
+			ContentType: info.ContentType,
+			Size:        info.Size,
+			Width:       info.Width,
+			Height:      info.Height,
+			SHA256:      info.SHA256,
+		})
+	}
+
+	t.promptsMux.Lock()
+	defer t.promptsMux.Unlock()
+
+	prompt.Storing = false
+	if err != nil {
+		prompt.Err = err
+	} else {
+		prompt.Outputs, prompt.Keys = outputs, keys
+	}
+	t.finalizePrompt(prompt, reason)
+}
+
+func (t *tracker) Cancel(promptID string) error {
+	t.promptsMux.Lock()
+	defer t.promptsMux.Unlock()
+
+	prompt, ok := t.allPrompts[promptID]
+	if !ok {
+		return fmt.Errorf("prompt ID %s is not being tracked", promptID)
+	}
+	if prompt.Storing {
+		return fmt.Errorf("prompt ID %s already finished executing", promptID)
+	}
+
+	prompt.Cancelled = true
+	t.finalizePrompt(prompt, "cancelled by client")
+
+	return nil
+}
+
+func (t *tracker) Fail(promptID string, err error) error {
+	t.promptsMux.Lock()
+	defer t.promptsMux.Unlock()
+
+	prompt, ok := t.allPrompts[promptID]
+	if !ok {
+		return fmt.Errorf("prompt ID %s is not being tracked", promptID)
+	}
+
+	prompt.Err = err
+	t.finalizePrompt(prompt, "failed outside of ComfyUI")
+
+	return nil
+}
+
+func (t *tracker) Resubmitted(promptID string) {
+	t.promptsMux.Lock()
+	defer t.promptsMux.Unlock()
+
+	if prompt, ok := t.allPrompts[promptID]; ok {
+		prompt.Retrying = false
+		prompt.LastActivity = time.Now()
+	}
+}
+
+func (t *tracker) Subscribe(promptID string, results Results, webhook notifier.Webhook) (<-chan *Result, error) {
+	t.promptsMux.Lock()
+	defer t.promptsMux.Unlock()
+
+	if _, exists := t.allPrompts[promptID]; exists {
+		return nil, fmt.Errorf("prompt ID %s is already being tracked", promptID)
+	}
+
+	newState := &PromptState{
+		ID:             promptID,
+		Results:        results,
+		ImagesReceived: make([]Image, 0, results.Count),
+		ResultChan:     make(chan *Result, 1),
+		Webhook:        webhook,
+		LastActivity:   time.Now(),
+	}
+
+	t.allPrompts[promptID] = newState
+
+	// Replay anything that arrived before the subscription, in order
+	for _, pending := range t.pending[promptID] {
+		if _, tracked := t.allPrompts[promptID]; !tracked {
+			break
+		}
+		t.applyEvent(newState, pending.event)
+	}
+	delete(t.pending, promptID)
+
+	return newState.ResultChan, nil
+}
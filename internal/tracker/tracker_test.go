@@ -0,0 +1,130 @@
+package tracker
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/CP-Payne/comfylite/internal/notifier"
+	"github.com/CP-Payne/comfylite/internal/store"
+)
+
+// newTestTracker returns a tracker without notifier or image store that follows one prompt.
+func newTestTracker(t *testing.T, results Results) (*tracker, <-chan *Result) {
+	t.Helper()
+	jobs := store.NewMemoryJobStore(0, 0)
+	if err := jobs.Create(&store.Job{ID: "p1", Status: store.StatusQueued}); err != nil {
+		t.Fatal(err)
+	}
+	tr := New(nil, jobs, nil).(*tracker)
+	resultChan, err := tr.Subscribe("p1", results, notifier.Webhook{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tr, resultChan
+}
+
+func TestCachedResultNodes(t *testing.T) {
+	png := Image{Data: []byte("png"), ContentType: "image/png"}
+
+	tests := []struct {
+		name    string
+		results Results
+		events  []Event
+		// wantErr is empty if the prompt should succeed
+		wantErr string
+	}{
+		{
+			name:    "cached save node reported from history",
+			results: Results{Count: 1},
+			events: []Event{
+				{Type: EventExecutionStart},
+				{Type: EventExecutionCached, Data: []string{"4", "9"}},
+				{Type: EventImageReceived, Node: "9", Data: OutputImage{Image: png}},
+				{Type: EventExecutionFinished},
+			},
+		},
+		{
+			name:    "cached configured output",
+			results: Results{Count: 1, Nodes: []string{"9"}},
+			events: []Event{
+				{Type: EventExecutionStart},
+				{Type: EventExecutionCached, Data: []string{"9"}},
+				{Type: EventImageReceived, Node: "9", Data: OutputImage{Image: png}},
+				{Type: EventExecutionFinished},
+			},
+		},
+		{
+			name:    "cached streaming node sends nothing",
+			results: Results{Count: 1, StreamNodes: []string{"12"}},
+			events: []Event{
+				{Type: EventExecutionStart},
+				{Type: EventExecutionCached, Data: []string{"4", "12"}},
+				{Type: EventExecutionFinished},
+			},
+			wantErr: "served result nodes 12 from its cache",
+		},
+		{
+			name:    "cached non-result nodes",
+			results: Results{Count: 1, StreamNodes: []string{"12"}},
+			events: []Event{
+				{Type: EventExecutionStart},
+				{Type: EventExecutionCached, Data: []string{"4"}},
+				{Type: EventExecutionFinished},
+			},
+			wantErr: "expected at least 1 images, got 0. finish_signal: true",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr, resultChan := newTestTracker(t, tt.results)
+			for _, event := range tt.events {
+				event.PromptID = "p1"
+				tr.processEvent(event)
+			}
+
+			result := <-resultChan
+			if tt.wantErr == "" {
+				if !result.Success || len(result.Images) != 1 {
+					t.Errorf("result = %+v, want success with one image", result)
+				}
+				return
+			}
+			if result.Success || result.Error == nil || !strings.HasSuffix(result.Error.Error(), tt.wantErr) {
+				t.Errorf("result = %+v, want an error ending in %q", result, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRetryIgnoresEventsUntilResubmitted(t *testing.T) {
+	tr, resultChan := newTestTracker(t, Results{Count: 1})
+	retries := 0
+	tr.SetHooks(Hooks{Retry: func(string, error) bool {
+		retries++
+		return retries == 1
+	}})
+
+	tr.processEvent(Event{Type: EventExecutionStart, PromptID: "p1"})
+	tr.processEvent(Event{Type: EventJobFailed, PromptID: "p1", Data: ErrTimeout})
+	if retries != 1 {
+		t.Fatalf("retries = %d, want 1", retries)
+	}
+
+	// Late events of the failed attempt must not finish the prompt
+	tr.processEvent(Event{Type: EventImageReceived, PromptID: "p1", Node: "9", Data: OutputImage{Image: Image{Data: []byte("old")}}})
+	tr.processEvent(Event{Type: EventExecutionFinished, PromptID: "p1"})
+	select {
+	case result := <-resultChan:
+		t.Fatalf("got result %+v from the failed attempt", result)
+	default:
+	}
+
+	tr.Resubmitted("p1")
+	tr.processEvent(Event{Type: EventImageReceived, PromptID: "p1", Node: "9", Data: OutputImage{Image: Image{Data: []byte("new")}}})
+	tr.processEvent(Event{Type: EventExecutionFinished, PromptID: "p1"})
+
+	result := <-resultChan
+	if !result.Success || len(result.Images) != 1 || string(result.Images[0].Data) != "new" {
+		t.Errorf("result = %+v, want the image of the new attempt", result)
+	}
+}
@@ -1,33 +1,152 @@
-package tracker
-
-type EventType string
-
-const (
-	EventExecutionStart    EventType = "EXECUTION_START"
-	EventExecutionFinished EventType = "EXECUTION_FINISHED"
-	EventImageReceived     EventType = "IMAGE_RECEIVED"
-	EventJobFailed         EventType = "JOB_FAILED"
-	EventProgress          EventType = "PROGRESS"
-	EventExecuting         EventType = "EXECUTING"
-)
-
-type Event struct {
-	Type     EventType
-	PromptID string
-	Data     interface{}
-}
-
-type PromptState struct {
-	ID                string
-	ImagesExpected    int
-	ImagesReceived    [][]byte
-	ExecutionFinished bool
-	ResultChan        chan *Result
-	WebhookURL        string
-}
-
-type Result struct {
-	Success bool
-	Images  [][]byte
-	Error   error
-}
+package tracker
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/CP-Payne/comfylite/internal/notifier"
+)
+
+var (
+	// ErrCancelled is the Result error of prompts that were cancelled by a client.
+	ErrCancelled = errors.New("job cancelled")
+	// ErrTimeout is the error of started prompts that stopped receiving events.
+	ErrTimeout = errors.New("timed out waiting for ComfyUI")
+	// ErrBackendLost is the error of prompts the ComfyUI instance lost, e.g. because it restarted.
+	ErrBackendLost = errors.New("ComfyUI lost the prompt")
+)
+
+type EventType string
+
+const (
+	EventExecutionStart       EventType = "EXECUTION_START"
+	EventExecutionFinished    EventType = "EXECUTION_FINISHED"
+	EventImageReceived        EventType = "IMAGE_RECEIVED"
+	EventJobFailed            EventType = "JOB_FAILED"
+	EventExecutionInterrupted EventType = "EXECUTION_INTERRUPTED"
+	EventExecutionCached      EventType = "EXECUTION_CACHED"
+	EventProgress             EventType = "PROGRESS"
+	EventExecuting            EventType = "EXECUTING"
+)
+
+type Event struct {
+	Type     EventType
+	PromptID string
+	// Node is the ID of the workflow node the event relates to, if any
+	Node string
+	// Data holds an Image streamed over the websocket or an OutputImage for EventImageReceived, a Progress for EventProgress, an
+	// *ExecutionError or other error for EventJobFailed and EventExecutionInterrupted, and the
+	// cached node IDs for EventExecutionCached
+	Data interface{}
+}
+
+type UpdateType string
+
+const (
+	UpdateStarted   UpdateType = "started"
+	UpdateExecuting UpdateType = "executing"
+	UpdateProgress  UpdateType = "progress"
+	UpdateResult    UpdateType = "result"
+	// UpdateRetrying is sent when an attempt failed and the prompt is queued again
+	UpdateRetrying UpdateType = "retrying"
+	// UpdatePreview carries a preview image, such as a sampler's latent preview
+	UpdatePreview UpdateType = "preview"
+)
+
+// Update is a live status change of a prompt, delivered to watchers.
+type Update struct {
+	Type     UpdateType `json:"type"`
+	PromptID string     `json:"prompt_id"`
+	Node     string     `json:"node,omitempty"`
+	Value    int        `json:"value,omitempty"`
+	Max      int        `json:"max,omitempty"`
+	Percent  float64    `json:"percent,omitempty"`
+	Error    string     `json:"error,omitempty"`
+	// Image is the base64 encoded image of an UpdatePreview
+	Image       string `json:"image,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+}
+
+// Image is an image of a prompt with its MIME type.
+type Image struct {
+	Data        []byte
+	ContentType string
+}
+
+// OutputImage is an image a node saved to a file, such as the output of SaveImage or PreviewImage.
+type OutputImage struct {
+	Image
+	// Temporary is set for files in ComfyUI's temp directory, which PreviewImage writes to
+	Temporary bool
+}
+
+// Results selects the images that make up a prompt's result.
+type Results struct {
+	// Count is the number of images the prompt must at least produce
+	Count int
+	// Nodes are the nodes whose images are the result. When empty, the images streamed by
+	// StreamNodes and the files saved to ComfyUI's output directory are.
+	Nodes []string
+	// StreamNodes are the nodes that send final images over the websocket, such as
+	// SaveImageWebsocket. Images other nodes send there are previews.
+	StreamNodes []string
+}
+
+// Progress is the step progress reported by a sampler node, carried in EventProgress.Data.
+type Progress struct {
+	Value int
+	Max   int
+}
+
+// ExecutionError is a failure reported by ComfyUI for a prompt.
+type ExecutionError struct {
+	NodeID        string
+	NodeType      string
+	ExceptionType string
+	Message       string
+	Traceback     []string
+	Interrupted   bool
+}
+
+func (e *ExecutionError) Error() string {
+	msg := e.Message
+	if e.ExceptionType != "" {
+		msg = e.ExceptionType + ": " + msg
+	}
+	if e.Interrupted {
+		msg = "execution interrupted"
+	}
+	if e.NodeID == "" {
+		return msg
+	}
+	return fmt.Sprintf("node %s (%s): %s", e.NodeID, e.NodeType, msg)
+}
+
+type PromptState struct {
+	ID                string
+	Results           Results
+	ImagesReceived    []Image
+	ExecutionFinished bool
+	ResultChan        chan *Result
+	Webhook           notifier.Webhook
+	Started           bool
+	LastActivity      time.Time
+	// Err is set when the prompt failed for a reason other than missing images
+	Err         error
+	CachedNodes []string
+	Cancelled   bool
+	// Storing is set while the images are written to the image store. Events are ignored meanwhile.
+	Storing bool
+	// Retrying is set from a failed attempt until the next one is submitted. Events are ignored
+	// meanwhile, as they can only come from the failed attempt.
+	Retrying bool
+	Outputs  []notifier.ImageOutput
+	Keys     []string
+}
+
+type Result struct {
+	Success bool
+	Images  []Image
+	Error   error
+}
@@ -0,0 +1,200 @@
+package workflow
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// jsonSchemaDialect is the JSON Schema version Describe generates
+const jsonSchemaDialect = "https://json-schema.org/draft/2020-12/schema"
+
+// modelExtensions are the file extensions of node inputs that name a model file
+var modelExtensions = []string{".safetensors", ".sft", ".ckpt", ".pt", ".pth", ".bin", ".gguf", ".onnx"}
+
+// Description tells clients what a workflow accepts and what it needs from ComfyUI.
+type Description struct {
+	Name string `json:"name"`
+	// Params is a JSON Schema of the params object of a generate request
+	Params map[string]any `json:"params"`
+	// Outputs lists the result nodes: the configured ones, or else the template's save nodes
+	Outputs  []string `json:"outputs,omitempty"`
+	Requires []string `json:"requires,omitempty"`
+	// NodeClasses lists the class_type of every node in the template
+	NodeClasses []string `json:"node_classes"`
+	Models      []Model  `json:"models,omitempty"`
+}
+
+// Model is a model file a node of the template loads.
+type Model struct {
+	NodeID    string `json:"node_id"`
+	ClassType string `json:"class_type"`
+	Input     string `json:"input"`
+	Name      string `json:"name"`
+	// Param is set when a request parameter can replace the model
+	Param string `json:"param,omitempty"`
+}
+
+// Describe returns the parameters of a workflow as a JSON Schema together with the node classes
+// and models its template depends on.
+func (m *manager) Describe(workflowName string) (*Description, error) {
+	config, err := m.Config(workflowName)
+	if err != nil {
+		return nil, err
+	}
+
+	templateData, err := os.ReadFile(m.templatePath(workflowName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read template: %w", err)
+	}
+	var nodes map[string]struct {
+		ClassType string         `json:"class_type"`
+		Inputs    map[string]any `json:"inputs"`
+	}
+	if err := json.Unmarshal(templateData, &nodes); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal template: %w", err)
+	}
+
+	schema, err := config.jsonSchema(workflowName)
+	if err != nil {
+		return nil, err
+	}
+	desc := &Description{
+		Name:        workflowName,
+		Params:      schema,
+		Outputs:     config.Outputs,
+		Requires:    config.Requires,
+		NodeClasses: []string{},
+	}
+
+	// The parameter written to each node input, to tell fixed models from configurable ones
+	params := make(map[Target]string)
+	for _, name := range config.ParamNames() {
+		for _, target := range config.Mappings[name].AllTargets() {
+			params[target] = name
+		}
+	}
+
+	ids := make([]string, 0, len(nodes))
+	for id := range nodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		node := nodes[id]
+		if node.ClassType != "" && !slices.Contains(desc.NodeClasses, node.ClassType) {
+			desc.NodeClasses = append(desc.NodeClasses, node.ClassType)
+		}
+		if len(config.Outputs) == 0 && savesImages(node.ClassType) {
+			desc.Outputs = append(desc.Outputs, id)
+		}
+		for _, input := range sortedKeys(node.Inputs) {
+			name, ok := node.Inputs[input].(string)
+			if !ok || !slices.Contains(modelExtensions, strings.ToLower(path.Ext(name))) {
+				continue
+			}
+			desc.Models = append(desc.Models, Model{
+				NodeID:    id,
+				ClassType: node.ClassType,
+				Input:     input,
+				Name:      name,
+				Param:     params[Target{NodeID: id, Property: input}],
+			})
+		}
+	}
+	sort.Strings(desc.NodeClasses)
+
+	return desc, nil
+}
+
+// savesImages reports whether nodes of the class produce results when a workflow lists no outputs:
+// the streaming nodes and SaveImage and its relatives. PreviewImage only writes temporary files.
+func savesImages(classType string) bool {
+	return slices.Contains(streamingClasses, classType) || strings.HasPrefix(classType, "Save")
+}
+
+// jsonSchema describes the params object a workflow accepts.
+func (c *WorkflowConfig) jsonSchema(workflowName string) (map[string]any, error) {
+	properties := make(map[string]any, len(c.Mappings))
+	required := []string{}
+	for _, name := range c.ParamNames() {
+		mapping := c.Mappings[name]
+		property, err := mapping.jsonSchema()
+		if err != nil {
+			return nil, fmt.Errorf("invalid parameter %s in workflow %s: %w", name, workflowName, err)
+		}
+		properties[name] = property
+		if mapping.Required {
+			required = append(required, name)
+		}
+	}
+
+	return map[string]any{
+		"$schema":              jsonSchemaDialect,
+		"title":                workflowName,
+		"type":                 "object",
+		"properties":           properties,
+		"required":             required,
+		"additionalProperties": false,
+	}, nil
+}
+
+// jsonSchema describes the values a parameter accepts. Images are given as base64 strings, the
+// form most generated clients can send, although data URIs, URLs and file uploads work as well.
+func (nm NodeMapping) jsonSchema() (map[string]any, error) {
+	schema := make(map[string]any)
+	switch nm.Type {
+	case TypeString:
+		schema["type"] = "string"
+	case TypeInt:
+		schema["type"] = "integer"
+	case TypeFloat:
+		schema["type"] = "number"
+	case TypeBool:
+		schema["type"] = "boolean"
+	case TypeImage, TypeMask:
+		schema["type"] = "string"
+		schema["contentEncoding"] = "base64"
+		schema["contentMediaType"] = "image/*"
+		if nm.MaskOf != "" {
+			schema["x-mask-of"] = nm.MaskOf
+		}
+	}
+	if nm.Description != "" {
+		schema["description"] = nm.Description
+	}
+
+	if nm.Default != nil && nm.Type != TypeImage && nm.Type != TypeMask {
+		value, err := nm.coerce(nm.Default)
+		if err != nil {
+			return nil, fmt.Errorf("invalid default: %w", err)
+		}
+		schema["default"] = value
+	}
+	if nm.Min != nil {
+		schema["minimum"] = *nm.Min
+	}
+	if nm.Max != nil {
+		schema["maximum"] = *nm.Max
+	}
+	if nm.Required && nm.Type == TypeString {
+		schema["minLength"] = 1
+	}
+	if len(nm.Enum) > 0 {
+		values := make([]any, 0, len(nm.Enum))
+		for _, option := range nm.Enum {
+			value, err := nm.coerce(option)
+			if err != nil {
+				return nil, fmt.Errorf("invalid enum value %v: %w", option, err)
+			}
+			values = append(values, value)
+		}
+		schema["enum"] = values
+	}
+
+	return schema, nil
+}
@@ -0,0 +1,62 @@
+package workflow
+
+import (
+	"reflect"
+	"testing"
+)
+
+const outputsTemplate = `{
+	"1": {"class_type": "CLIPTextEncode", "inputs": {"text": ""}},
+	"9": {"class_type": "SaveImage", "inputs": {"images": ["8", 0]}},
+	"10": {"class_type": "PreviewImage", "inputs": {"images": ["8", 0]}},
+	"11": {"class_type": "SaveImageWebsocket", "inputs": {"images": ["8", 0]}},
+	"12": {"class_type": "SaveAnimatedWEBP", "inputs": {"images": ["8", 0]}}
+}`
+
+func TestDescribeOutputs(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		want   []string
+	}{
+		{
+			name:   "derived from the template",
+			config: "node_mappings:\n  prompt: {node_id: \"1\", property: text, type: string}\n",
+			want:   []string{"11", "12", "9"},
+		},
+		{
+			name:   "configured",
+			config: "outputs: [\"10\"]\nnode_mappings:\n  prompt: {node_id: \"1\", property: text, type: string}\n",
+			want:   []string{"10"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			desc, err := newTestManager(t, outputsTemplate, tt.config).Describe("test")
+			if err != nil {
+				t.Fatalf("Describe() = %v", err)
+			}
+			if !reflect.DeepEqual(desc.Outputs, tt.want) {
+				t.Errorf("Outputs = %q, want %q", desc.Outputs, tt.want)
+			}
+		})
+	}
+}
+
+func TestDescribeShippedWorkflows(t *testing.T) {
+	m := NewManager("../../templates", "../../configs")
+	names, err := m.List()
+	if err != nil || len(names) == 0 {
+		t.Fatalf("List() = %v, %v, want the shipped workflows", names, err)
+	}
+	for _, name := range names {
+		desc, err := m.Describe(name)
+		if err != nil {
+			t.Errorf("Describe(%s) = %v", name, err)
+			continue
+		}
+		if len(desc.Outputs) == 0 {
+			t.Errorf("Describe(%s) lists no outputs", name)
+		}
+	}
+}
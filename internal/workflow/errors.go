@@ -0,0 +1,31 @@
+package workflow
+
+import (
+	"fmt"
+	"strings"
+)
+
+// FieldError describes a problem with a single request parameter.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError is returned by Build when the supplied parameters do not fit the workflow config.
+// The API surfaces it as a 400 response listing every offending field.
+type ValidationError struct {
+	Workflow string
+	Fields   []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, 0, len(e.Fields))
+	for _, f := range e.Fields {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", f.Field, f.Message))
+	}
+	return fmt.Sprintf("invalid parameters for workflow %q: %s", e.Workflow, strings.Join(msgs, "; "))
+}
+
+func (e *ValidationError) add(field, format string, args ...any) {
+	e.Fields = append(e.Fields, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
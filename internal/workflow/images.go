@@ -0,0 +1,64 @@
+package workflow
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// InputImage is the value of an image or mask parameter before it has been uploaded to ComfyUI.
+// Either Data or URL is set.
+type InputImage struct {
+	Data        []byte
+	ContentType string
+	// Filename is the name the client gave the image, if any
+	Filename string
+	// URL is fetched by the service before the image is uploaded
+	URL string
+}
+
+// UploadedImage is the name of an image in ComfyUI's input directory, as LoadImage expects it.
+// The service replaces every InputImage with one before the workflow is built.
+type UploadedImage string
+
+// coerceImage accepts an uploaded file, a data URI, a base64 string or an http(s) URL.
+func coerceImage(v interface{}) (interface{}, error) {
+	switch image := v.(type) {
+	case UploadedImage:
+		return image, nil
+	case InputImage:
+		if image.URL != "" {
+			return image, nil
+		}
+		return checkImage(image)
+	case string:
+		image = strings.TrimSpace(image)
+		if u, err := url.Parse(image); err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" {
+			return InputImage{URL: image}, nil
+		}
+		if rest, ok := strings.CutPrefix(image, "data:"); ok {
+			// data:image/png;base64,...
+			if _, encoded, ok := strings.Cut(rest, ";base64,"); ok {
+				image = encoded
+			}
+		}
+		data, err := base64.StdEncoding.DecodeString(image)
+		if err != nil {
+			return nil, fmt.Errorf("must be a base64 encoded image, a data URI or an http(s) URL")
+		}
+		return checkImage(InputImage{Data: data})
+	}
+	return nil, fmt.Errorf("must be a base64 encoded image, a data URI or an http(s) URL")
+}
+
+// checkImage makes sure the data is an image and fills in its content type.
+func checkImage(image InputImage) (InputImage, error) {
+	contentType := http.DetectContentType(image.Data)
+	if !strings.HasPrefix(contentType, "image/") {
+		return InputImage{}, fmt.Errorf("must be an image, got %s", contentType)
+	}
+	image.ContentType = contentType
+	return image, nil
+}
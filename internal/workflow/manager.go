@@ -1,73 +1,233 @@
-package workflow
-
-import (
-	"encoding/json"
-	"fmt"
-	"os"
-	"path/filepath"
-
-	"gopkg.in/yaml.v2"
-)
-
-type Manager interface {
-	Build(workflowName string, params map[string]interface{}) ([]byte, error)
-}
-
-type NodeMapping struct {
-	NodeID   string `yaml:"node_id"`
-	Property string `yaml:"property"`
-}
-
-type WorkflowConfig struct {
-	Mappings map[string]NodeMapping `yaml:"node_mappings"`
-}
-
-type manager struct {
-	templateDir string
-	configDir   string
-}
-
-func NewManager(templateDir, configDir string) Manager {
-	return &manager{templateDir: templateDir, configDir: configDir}
-}
-
-func (m *manager) Build(workflowName string, params map[string]interface{}) ([]byte, error) {
-	templatePath := filepath.Join(m.templateDir, workflowName+".json")
-	templateData, err := os.ReadFile(templatePath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read template: %w", err)
-	}
-	var workflow map[string]interface{}
-	if err := json.Unmarshal(templateData, &workflow); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal template: %w", err)
-	}
-
-	configPath := filepath.Join(m.configDir, workflowName+".yaml")
-	configData, err := os.ReadFile(configPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read config: %w", err)
-	}
-	var config WorkflowConfig
-	if err := yaml.Unmarshal(configData, &config); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal config: %w", err)
-	}
-
-	for key, value := range params {
-		mapping, ok := config.Mappings[key]
-		if !ok {
-			continue
-		}
-
-		node, ok := workflow[mapping.NodeID].(map[string]interface{})
-		if !ok {
-			return nil, fmt.Errorf("node %s not found or not an object", mapping.NodeID)
-		}
-		inputs, ok := node["inputs"].(map[string]interface{})
-		if !ok {
-			return nil, fmt.Errorf("inputs for node %s not found", mapping.NodeID)
-		}
-		inputs[mapping.Property] = value
-	}
-
-	return json.Marshal(workflow)
-}
+package workflow
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ErrWorkflowNotFound is returned when no template/config pair exists for a workflow name.
+var ErrWorkflowNotFound = errors.New("workflow not found")
+
+// Workflow names double as file names, so only allow a safe subset of characters.
+var validName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+type Manager interface {
+	Build(workflowName string, params map[string]interface{}) ([]byte, error)
+	Resolve(workflowName string, params map[string]interface{}) (map[string]interface{}, error)
+	Config(workflowName string) (*WorkflowConfig, error)
+	List() ([]string, error)
+	Exists(workflowName string) bool
+	// Describe returns the workflow's parameters as a JSON Schema and what it needs from ComfyUI.
+	Describe(workflowName string) (*Description, error)
+}
+
+// NodeMapping maps a request parameter onto one or more node inputs and describes the values it
+// accepts. A parameter needs either node_id/property, a list of targets, or both.
+type NodeMapping struct {
+	NodeID      string        `yaml:"node_id"`
+	Property    string        `yaml:"property"`
+	Targets     []Target      `yaml:"targets"`
+	Type        ParamType     `yaml:"type"`
+	Default     interface{}   `yaml:"default"`
+	Required    bool          `yaml:"required"`
+	Min         *float64      `yaml:"min"`
+	Max         *float64      `yaml:"max"`
+	Enum        []interface{} `yaml:"enum"`
+	Description string        `yaml:"description"`
+	// MaskOf names the image parameter a mask parameter applies to
+	MaskOf string `yaml:"mask_of"`
+}
+
+type WorkflowConfig struct {
+	Mappings map[string]NodeMapping `yaml:"node_mappings"`
+	// Requires lists the tags a ComfyUI backend needs to run the workflow, e.g. the models it uses
+	Requires []string    `yaml:"requires"`
+	Retry    RetryPolicy `yaml:"retry"`
+	// Outputs lists the IDs of the nodes whose images are returned. When empty, the images of every
+	// SaveImageWebsocket, SaveImage or similar node are returned, but not those of PreviewImage.
+	Outputs []string `yaml:"outputs"`
+}
+
+type manager struct {
+	templateDir string
+	configDir   string
+}
+
+func NewManager(templateDir, configDir string) Manager {
+	return &manager{templateDir: templateDir, configDir: configDir}
+}
+
+// List returns the names of all workflows that have both a template and a config file.
+// The directories are scanned on every call so new workflows are picked up without a restart.
+func (m *manager) List() ([]string, error) {
+	entries, err := os.ReadDir(m.templateDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read template directory: %w", err)
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		name := strings.TrimSuffix(entry.Name(), ".json")
+		if m.Exists(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+func (m *manager) Exists(workflowName string) bool {
+	if !validName.MatchString(workflowName) {
+		return false
+	}
+
+	for _, path := range []string{m.templatePath(workflowName), m.configPath(workflowName)} {
+		info, err := os.Stat(path)
+		if err != nil || info.IsDir() {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (m *manager) templatePath(workflowName string) string {
+	return filepath.Join(m.templateDir, workflowName+".json")
+}
+
+func (m *manager) configPath(workflowName string) string {
+	return filepath.Join(m.configDir, workflowName+".yaml")
+}
+
+// Config loads the parameter mappings for a workflow.
+func (m *manager) Config(workflowName string) (*WorkflowConfig, error) {
+	if !m.Exists(workflowName) {
+		return nil, fmt.Errorf("%w: %q", ErrWorkflowNotFound, workflowName)
+	}
+
+	configData, err := os.ReadFile(m.configPath(workflowName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+	var config WorkflowConfig
+	if err := yaml.Unmarshal(configData, &config); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal config: %w", err)
+	}
+	if err := config.Retry.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config for workflow %q: %w", workflowName, err)
+	}
+	for name, mapping := range config.Mappings {
+		if mapping.MaskOf == "" {
+			continue
+		}
+		if mapping.Type != TypeMask || config.Mappings[mapping.MaskOf].Type != TypeImage {
+			return nil, fmt.Errorf("invalid config for workflow %q: %s: mask_of must be set on a mask and name an image parameter", workflowName, name)
+		}
+	}
+
+	return &config, nil
+}
+
+// ParamNames returns the sorted parameter names a workflow config accepts.
+func (c *WorkflowConfig) ParamNames() []string {
+	names := make([]string, 0, len(c.Mappings))
+	for name := range c.Mappings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Build applies params to the workflow template after running them through Resolve.
+func (m *manager) Build(workflowName string, params map[string]interface{}) ([]byte, error) {
+	resolved, err := m.Resolve(workflowName, params)
+	if err != nil {
+		return nil, err
+	}
+	config, err := m.Config(workflowName)
+	if err != nil {
+		return nil, err
+	}
+
+	templateData, err := os.ReadFile(m.templatePath(workflowName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read template: %w", err)
+	}
+	var workflow map[string]interface{}
+	if err := json.Unmarshal(templateData, &workflow); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal template: %w", err)
+	}
+	for _, node := range config.Outputs {
+		if _, ok := workflow[node]; !ok {
+			return nil, fmt.Errorf("output node %q of workflow %q is not in the template", node, workflowName)
+		}
+	}
+
+	missingErr := &MissingTargetsError{Workflow: workflowName}
+	for _, key := range sortedKeys(resolved) {
+		mapping := config.Mappings[key]
+
+		targets := mapping.AllTargets()
+		if len(targets) == 0 {
+			missingErr.Targets = append(missingErr.Targets, MissingTarget{Param: key, Reason: "no targets configured"})
+		}
+		if _, ok := resolved[key].(InputImage); ok {
+			return nil, fmt.Errorf("image parameter %s of workflow %q has not been uploaded", key, workflowName)
+		}
+		for _, target := range targets {
+			if err := target.apply(workflow, resolved[key]); err != nil {
+				missingErr.Targets = append(missingErr.Targets, MissingTarget{Param: key, Target: target, Reason: err.Error()})
+			}
+		}
+	}
+	if len(missingErr.Targets) > 0 {
+		return nil, missingErr
+	}
+
+	return json.Marshal(workflow)
+}
+
+// streamingClasses are node classes that send their images over the websocket instead of saving them.
+var streamingClasses = []string{"SaveImageWebsocket", "ETN_SendImageWebSocket"}
+
+// StreamNodes returns the IDs of the nodes in a built workflow that send their images over the
+// websocket. Other images ComfyUI sends there, like sampler previews, are not results.
+func StreamNodes(workflow []byte) ([]string, error) {
+	var nodes map[string]struct {
+		ClassType string `json:"class_type"`
+	}
+	if err := json.Unmarshal(workflow, &nodes); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal workflow: %w", err)
+	}
+
+	var ids []string
+	for id, node := range nodes {
+		if slices.Contains(streamingClasses, node.ClassType) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,233 @@
+package workflow
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ParamType is the declared type of a workflow parameter. An empty type accepts any value unchanged.
+type ParamType string
+
+const (
+	TypeString ParamType = "string"
+	TypeInt    ParamType = "int"
+	TypeFloat  ParamType = "float"
+	TypeBool   ParamType = "bool"
+	// TypeImage is an image that is uploaded to ComfyUI, for LoadImage and similar nodes
+	TypeImage ParamType = "image"
+	// TypeMask is an inpainting mask. With mask_of it is merged into that image parameter's upload.
+	TypeMask ParamType = "mask"
+)
+
+// Resolve validates params against the workflow config and returns a new map with every value
+// coerced to its declared type and defaults filled in. All problems are collected into a single
+// *ValidationError so clients can fix every field in one go.
+func (m *manager) Resolve(workflowName string, params map[string]interface{}) (map[string]interface{}, error) {
+	config, err := m.Config(workflowName)
+	if err != nil {
+		return nil, err
+	}
+
+	validationErr := &ValidationError{Workflow: workflowName}
+	resolved := make(map[string]interface{}, len(config.Mappings))
+
+	for key := range params {
+		if _, ok := config.Mappings[key]; !ok {
+			validationErr.add(key, "unknown parameter, expected one of: %s", strings.Join(config.ParamNames(), ", "))
+		}
+	}
+
+	for _, name := range config.ParamNames() {
+		mapping := config.Mappings[name]
+
+		raw, ok := params[name]
+		if !ok || raw == nil {
+			if mapping.Default != nil {
+				value, err := mapping.coerce(mapping.Default)
+				if err != nil {
+					return nil, fmt.Errorf("invalid default for parameter %s in workflow %s: %w", name, workflowName, err)
+				}
+				resolved[name] = value
+			} else if mapping.Required {
+				validationErr.add(name, "is required")
+			}
+			continue
+		}
+
+		value, err := mapping.coerce(raw)
+		if err != nil {
+			validationErr.add(name, "%v", err)
+			continue
+		}
+		if err := mapping.check(value); err != nil {
+			validationErr.add(name, "%v", err)
+			continue
+		}
+		resolved[name] = value
+	}
+
+	if len(validationErr.Fields) > 0 {
+		sort.SliceStable(validationErr.Fields, func(i, j int) bool { return validationErr.Fields[i].Field < validationErr.Fields[j].Field })
+		return nil, validationErr
+	}
+
+	return resolved, nil
+}
+
+// coerce converts a JSON or YAML decoded value to the mapping's declared type.
+func (nm NodeMapping) coerce(v interface{}) (interface{}, error) {
+	switch nm.Type {
+	case "":
+		return v, nil
+	case TypeString:
+		switch s := v.(type) {
+		case string:
+			return s, nil
+		case json.Number:
+			return s.String(), nil
+		case int, int64, uint64, float64:
+			return fmt.Sprint(s), nil
+		}
+	case TypeInt:
+		if _, ok := toFloat(v); ok {
+			return coerceInt(v)
+		}
+	case TypeFloat:
+		if f, ok := toFloat(v); ok {
+			return f, nil
+		}
+	case TypeImage, TypeMask:
+		return coerceImage(v)
+	case TypeBool:
+		switch b := v.(type) {
+		case bool:
+			return b, nil
+		case string:
+			if parsed, err := strconv.ParseBool(b); err == nil {
+				return parsed, nil
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported parameter type %q", nm.Type)
+	}
+
+	return nil, fmt.Errorf("must be of type %s, got %v", nm.Type, v)
+}
+
+// check applies the min/max and enum constraints to an already coerced value.
+func (nm NodeMapping) check(v interface{}) error {
+	if nm.Type == TypeImage || nm.Type == TypeMask {
+		return nil
+	}
+	if s, ok := v.(string); ok && nm.Required && s == "" {
+		return fmt.Errorf("cannot be empty")
+	}
+
+	if nm.Min != nil || nm.Max != nil {
+		if f, ok := toFloat(v); ok {
+			if nm.Min != nil && f < *nm.Min {
+				return fmt.Errorf("must be at least %v", *nm.Min)
+			}
+			if nm.Max != nil && f > *nm.Max {
+				return fmt.Errorf("must be at most %v", *nm.Max)
+			}
+		}
+	}
+
+	if len(nm.Enum) > 0 {
+		options := make([]string, 0, len(nm.Enum))
+		for _, option := range nm.Enum {
+			coerced, err := nm.coerce(option)
+			if err == nil && coerced == v {
+				return nil
+			}
+			options = append(options, fmt.Sprint(option))
+		}
+		return fmt.Errorf("must be one of: %s", strings.Join(options, ", "))
+	}
+
+	return nil
+}
+
+// coerceInt converts a number to int64, or to uint64 above math.MaxInt64 as ComfyUI seeds go up to
+// 2^64-1. Integers are parsed directly so large seeds do not lose precision through float64.
+func coerceInt(v interface{}) (interface{}, error) {
+	switch n := v.(type) {
+	case int:
+		return int64(n), nil
+	case int64:
+		return n, nil
+	case uint64:
+		if n <= math.MaxInt64 {
+			return int64(n), nil
+		}
+		return n, nil
+	}
+
+	if s, ok := numberString(v); ok {
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err == nil {
+			return i, nil
+		}
+		if u, err := strconv.ParseUint(s, 10, 64); err == nil {
+			return u, nil
+		}
+		if errors.Is(err, strconv.ErrRange) {
+			return nil, intRangeError(v)
+		}
+	}
+
+	// Floats such as 512.0 or 1e3. 2^63 and 2^64 are exact as float64, so the bounds are too.
+	f, _ := toFloat(v)
+	if f != math.Trunc(f) {
+		return nil, fmt.Errorf("must be an integer, got %v", v)
+	}
+	switch {
+	case f < math.MinInt64 || f >= math.MaxUint64:
+		return nil, intRangeError(v)
+	case f >= math.MaxInt64:
+		return uint64(f), nil
+	}
+	return int64(f), nil
+}
+
+func intRangeError(v interface{}) error {
+	return fmt.Errorf("%v is out of range, integers must be between %d and %d", v, int64(math.MinInt64), uint64(math.MaxUint64))
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case float64:
+		return n, true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(n), 64)
+		return f, err == nil
+	default:
+		return 0, false
+	}
+}
+
+func numberString(v interface{}) (string, bool) {
+	switch n := v.(type) {
+	case json.Number:
+		return n.String(), true
+	case string:
+		return strings.TrimSpace(n), true
+	default:
+		return "", false
+	}
+}
@@ -0,0 +1,193 @@
+package workflow
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testTemplate = `{
+	"1": {"class_type": "CLIPTextEncode", "inputs": {"text": ""}},
+	"2": {"class_type": "KSampler", "inputs": {"seed": 0, "steps": 20, "cfg": 8, "sampler_name": "euler"}},
+	"3": {"class_type": "VAEDecode", "inputs": {"tiled": false}}
+}`
+
+const testConfig = `
+node_mappings:
+  prompt: {node_id: "1", property: text, type: string, required: true}
+  seed: {node_id: "2", property: seed, type: int, min: 0}
+  steps: {node_id: "2", property: steps, type: int, min: 1, max: 100, default: 20}
+  cfg: {node_id: "2", property: cfg, type: float, min: 0, max: 30, default: 7.5}
+  sampler: {node_id: "2", property: sampler_name, type: string, enum: [euler, dpmpp_2m], default: euler}
+  tiled: {node_id: "3", property: tiled, type: bool, default: false}
+`
+
+// newTestManager returns a manager for a single workflow named "test".
+func newTestManager(t *testing.T, template, config string) Manager {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "test.json"), []byte(template), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "test.yaml"), []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return NewManager(dir, dir)
+}
+
+func TestCoerceInt(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      interface{}
+		want    interface{}
+		wantErr string
+	}{
+		{name: "json number", in: json.Number("42"), want: int64(42)},
+		{name: "string with spaces", in: " 42 ", want: int64(42)},
+		{name: "yaml int", in: 7, want: int64(7)},
+		{name: "negative", in: json.Number("-3"), want: int64(-3)},
+		{name: "integral float", in: 512.0, want: int64(512)},
+		{name: "integral json float", in: json.Number("512.0"), want: int64(512)},
+		{name: "exponent", in: "1e3", want: int64(1000)},
+		{name: "max int64", in: json.Number("9223372036854775807"), want: int64(math.MaxInt64)},
+		{name: "seed above max int64", in: json.Number("12345678901234567890"), want: uint64(12345678901234567890)},
+		{name: "max uint64", in: "18446744073709551615", want: uint64(math.MaxUint64)},
+		{name: "yaml uint64", in: uint64(math.MaxUint64), want: uint64(math.MaxUint64)},
+		{name: "float above max int64", in: 1.8e19, want: uint64(18000000000000000000)},
+		{name: "fraction", in: 1.5, wantErr: "must be an integer"},
+		{name: "fraction string", in: json.Number("1.5"), wantErr: "must be an integer"},
+		{name: "above max uint64", in: json.Number("18446744073709551616"), wantErr: "out of range"},
+		{name: "below min int64", in: json.Number("-9223372036854775809"), wantErr: "out of range"},
+		{name: "float 2^64", in: 18446744073709551616.0, wantErr: "out of range"},
+		{name: "not a number", in: "abc", wantErr: "must be of type int"},
+		{name: "bool", in: true, wantErr: "must be of type int"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NodeMapping{Type: TypeInt}.coerce(tt.in)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("coerce(%v) = %v, %v, want error containing %q", tt.in, got, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("coerce(%v) = %v", tt.in, err)
+			}
+			if got != tt.want {
+				t.Errorf("coerce(%v) = %T %v, want %T %v", tt.in, got, got, tt.want, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolve(t *testing.T) {
+	m := newTestManager(t, testTemplate, testConfig)
+
+	tests := []struct {
+		name   string
+		params map[string]interface{}
+		want   map[string]interface{}
+		// wantFields maps each rejected field to a part of its message
+		wantFields map[string]string
+	}{
+		{
+			name:   "defaults",
+			params: map[string]interface{}{"prompt": "a cat"},
+			want: map[string]interface{}{
+				"prompt": "a cat", "steps": int64(20), "cfg": 7.5, "sampler": "euler", "tiled": false,
+			},
+		},
+		{
+			name: "strings and json numbers",
+			params: map[string]interface{}{
+				"prompt": "a cat", "seed": json.Number("12345678901234567890"), "steps": "30", "cfg": json.Number("8"),
+				"sampler": "dpmpp_2m", "tiled": "true",
+			},
+			want: map[string]interface{}{
+				"prompt": "a cat", "seed": uint64(12345678901234567890), "steps": int64(30), "cfg": 8.0,
+				"sampler": "dpmpp_2m", "tiled": true,
+			},
+		},
+		{
+			name:   "integral float for int",
+			params: map[string]interface{}{"prompt": "a cat", "steps": 64.0},
+			want: map[string]interface{}{
+				"prompt": "a cat", "steps": int64(64), "cfg": 7.5, "sampler": "euler", "tiled": false,
+			},
+		},
+		{
+			name: "every problem is reported",
+			params: map[string]interface{}{
+				"seed": -1, "steps": 1.5, "cfg": 31, "sampler": "ddim", "tiled": "maybe", "strength": 1,
+			},
+			wantFields: map[string]string{
+				"prompt":   "is required",
+				"seed":     "must be at least 0",
+				"steps":    "must be an integer",
+				"cfg":      "must be at most 30",
+				"sampler":  "must be one of: euler, dpmpp_2m",
+				"tiled":    "must be of type bool",
+				"strength": "unknown parameter",
+			},
+		},
+		{
+			name:       "below min",
+			params:     map[string]interface{}{"prompt": "a cat", "steps": json.Number("0")},
+			wantFields: map[string]string{"steps": "must be at least 1"},
+		},
+		{
+			name:       "empty required string",
+			params:     map[string]interface{}{"prompt": ""},
+			wantFields: map[string]string{"prompt": "cannot be empty"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := m.Resolve("test", tt.params)
+			if tt.wantFields == nil {
+				if err != nil {
+					t.Fatalf("Resolve() = %v", err)
+				}
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("Resolve() = %#v, want %#v", got, tt.want)
+				}
+				return
+			}
+
+			var validationErr *ValidationError
+			if !errors.As(err, &validationErr) {
+				t.Fatalf("Resolve() = %v, want a *ValidationError", err)
+			}
+			if len(validationErr.Fields) != len(tt.wantFields) {
+				t.Errorf("got %d field errors, want %d: %v", len(validationErr.Fields), len(tt.wantFields), validationErr)
+			}
+			for i, field := range validationErr.Fields {
+				if i > 0 && validationErr.Fields[i-1].Field > field.Field {
+					t.Errorf("field errors are not sorted: %v", validationErr.Fields)
+				}
+				want, ok := tt.wantFields[field.Field]
+				if !ok || !strings.Contains(field.Message, want) {
+					t.Errorf("%s: %q, want it to contain %q", field.Field, field.Message, want)
+				}
+			}
+		})
+	}
+}
+
+func TestResolveInvalidDefault(t *testing.T) {
+	m := newTestManager(t, testTemplate, `
+node_mappings:
+  steps: {node_id: "2", property: steps, type: int, default: many}
+`)
+	_, err := m.Resolve("test", map[string]interface{}{})
+	var validationErr *ValidationError
+	if err == nil || errors.As(err, &validationErr) {
+		t.Errorf("Resolve() = %v, want a config error", err)
+	}
+}
@@ -0,0 +1,51 @@
+package workflow
+
+import (
+	"fmt"
+	"slices"
+	"time"
+)
+
+// ErrorClass groups job failures for retry policies.
+type ErrorClass string
+
+const (
+	// ClassBackendLost means the ComfyUI instance went away and lost the prompt, e.g. it crashed.
+	ClassBackendLost ErrorClass = "backend_lost"
+	// ClassTimeout means the prompt stopped reporting progress.
+	ClassTimeout ErrorClass = "timeout"
+	// ClassOOM means ComfyUI ran out of memory executing the prompt.
+	ClassOOM ErrorClass = "oom"
+	// ClassSubmit means the prompt could not be handed to any ComfyUI instance.
+	ClassSubmit ErrorClass = "submit"
+	// ClassExecution is any other error raised by a node while executing.
+	ClassExecution ErrorClass = "execution"
+	// ClassRejected means ComfyUI refused the workflow as invalid. It is never retried.
+	ClassRejected ErrorClass = "rejected"
+)
+
+var retryableClasses = []ErrorClass{ClassBackendLost, ClassTimeout, ClassOOM, ClassSubmit, ClassExecution}
+
+// RetryPolicy decides whether a failed job of a workflow is attempted again.
+type RetryPolicy struct {
+	// MaxAttempts includes the first attempt, so 0 or 1 disables retries.
+	MaxAttempts int `yaml:"max_attempts"`
+	// RetryOn lists the error classes worth another attempt.
+	RetryOn []ErrorClass `yaml:"retry_on"`
+	// Delay is how long a job waits before it is queued again.
+	Delay time.Duration `yaml:"delay"`
+}
+
+// ShouldRetry reports whether a job that failed its attempt-th attempt with an error of class gets another one.
+func (p RetryPolicy) ShouldRetry(attempt int, class ErrorClass) bool {
+	return attempt < p.MaxAttempts && slices.Contains(p.RetryOn, class)
+}
+
+func (p RetryPolicy) validate() error {
+	for _, class := range p.RetryOn {
+		if !slices.Contains(retryableClasses, class) {
+			return fmt.Errorf("retry_on: %q is not a retryable error class, expected one of %v", class, retryableClasses)
+		}
+	}
+	return nil
+}
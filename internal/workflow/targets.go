@@ -0,0 +1,117 @@
+package workflow
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Target is a single node input that a parameter is written to.
+// Property is either a plain input name, a dotted path ("options.strength") or a
+// JSON pointer ("/options/strength") into nested input objects and arrays.
+type Target struct {
+	NodeID   string `yaml:"node_id"`
+	Property string `yaml:"property"`
+}
+
+func (t Target) String() string {
+	return fmt.Sprintf("node %s property %s", t.NodeID, t.Property)
+}
+
+// MissingTarget describes a target that could not be found in the workflow template.
+type MissingTarget struct {
+	Param  string
+	Target Target
+	Reason string
+}
+
+// MissingTargetsError is returned by Build when one or more mapped targets do not exist in the
+// template. It usually means the config and template have drifted apart.
+type MissingTargetsError struct {
+	Workflow string
+	Targets  []MissingTarget
+}
+
+func (e *MissingTargetsError) Error() string {
+	msgs := make([]string, 0, len(e.Targets))
+	for _, t := range e.Targets {
+		msgs = append(msgs, fmt.Sprintf("%s -> %s: %s", t.Param, t.Target, t.Reason))
+	}
+	return fmt.Sprintf("workflow %q has missing targets: %s", e.Workflow, strings.Join(msgs, "; "))
+}
+
+// AllTargets returns the single node_id/property pair, if set, followed by any entries in targets.
+func (nm NodeMapping) AllTargets() []Target {
+	targets := make([]Target, 0, len(nm.Targets)+1)
+	if nm.NodeID != "" {
+		targets = append(targets, Target{NodeID: nm.NodeID, Property: nm.Property})
+	}
+	return append(targets, nm.Targets...)
+}
+
+// apply writes value into the target's node inputs within workflow.
+func (t Target) apply(workflow map[string]interface{}, value interface{}) error {
+	node, ok := workflow[t.NodeID].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("node %s not found or not an object", t.NodeID)
+	}
+	inputs, ok := node["inputs"].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("inputs for node %s not found", t.NodeID)
+	}
+
+	path := splitPath(t.Property)
+	if len(path) == 0 {
+		return fmt.Errorf("empty property path")
+	}
+
+	var container interface{} = inputs
+	for i, segment := range path {
+		last := i == len(path)-1
+
+		switch c := container.(type) {
+		case map[string]interface{}:
+			// Inputs are only replaced, a missing one means the target does not match the template
+			next, ok := c[segment]
+			if !ok {
+				return fmt.Errorf("%q not found", strings.Join(path[:i+1], "."))
+			}
+			if last {
+				c[segment] = value
+				return nil
+			}
+			container = next
+		case []interface{}:
+			index, err := strconv.Atoi(segment)
+			if err != nil || index < 0 || index >= len(c) {
+				return fmt.Errorf("index %q out of range at %q", segment, strings.Join(path[:i], "."))
+			}
+			if last {
+				c[index] = value
+				return nil
+			}
+			container = c[index]
+		default:
+			return fmt.Errorf("%q is not an object or array", strings.Join(path[:i], "."))
+		}
+	}
+
+	return nil
+}
+
+// splitPath turns a dotted path or JSON pointer into its segments.
+func splitPath(property string) []string {
+	if !strings.HasPrefix(property, "/") {
+		if property == "" {
+			return nil
+		}
+		return strings.Split(property, ".")
+	}
+
+	segments := strings.Split(property[1:], "/")
+	for i, segment := range segments {
+		// RFC 6901 escaping: ~1 is '/', ~0 is '~'
+		segments[i] = strings.ReplaceAll(strings.ReplaceAll(segment, "~1", "/"), "~0", "~")
+	}
+	return segments
+}
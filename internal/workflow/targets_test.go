@@ -0,0 +1,155 @@
+package workflow
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitPath(t *testing.T) {
+	tests := []struct {
+		property string
+		want     []string
+	}{
+		{property: "", want: nil},
+		{property: "seed", want: []string{"seed"}},
+		{property: "options.strength", want: []string{"options", "strength"}},
+		{property: "loras.1.weight", want: []string{"loras", "1", "weight"}},
+		{property: "/options/strength", want: []string{"options", "strength"}},
+		{property: "/a~1b/c~0d", want: []string{"a/b", "c~d"}},
+		// ~01 is a literal "~1", not a slash
+		{property: "/~01", want: []string{"~1"}},
+		{property: "/", want: []string{""}},
+	}
+	for _, tt := range tests {
+		if got := splitPath(tt.property); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitPath(%q) = %q, want %q", tt.property, got, tt.want)
+		}
+	}
+}
+
+const targetsTemplate = `{
+	"5": {"class_type": "CustomSampler", "inputs": {
+		"seed": 0,
+		"options": {"strength": 0.5, "a/b": 1, "c~d": 2},
+		"loras": [{"name": "x", "weight": 1}, {"name": "y", "weight": 1}],
+		"model": ["4", 0]
+	}},
+	"6": {"class_type": "Broken", "inputs": "none"}
+}`
+
+func TestTargetApply(t *testing.T) {
+	tests := []struct {
+		name     string
+		target   Target
+		wantJSON string
+		wantErr  string
+	}{
+		{name: "plain input", target: Target{NodeID: "5", Property: "seed"}, wantJSON: `{"seed": 42}`},
+		{name: "dotted path", target: Target{NodeID: "5", Property: "options.strength"}, wantJSON: `{"options": {"strength": 42}}`},
+		{name: "json pointer", target: Target{NodeID: "5", Property: "/options/strength"}, wantJSON: `{"options": {"strength": 42}}`},
+		{name: "escaped slash", target: Target{NodeID: "5", Property: "/options/a~1b"}, wantJSON: `{"options": {"a/b": 42}}`},
+		{name: "escaped tilde", target: Target{NodeID: "5", Property: "/options/c~0d"}, wantJSON: `{"options": {"c~d": 42}}`},
+		{name: "array index", target: Target{NodeID: "5", Property: "loras.1.weight"}, wantJSON: `{"loras": [{}, {"weight": 42}]}`},
+		{name: "array element", target: Target{NodeID: "5", Property: "/loras/0"}, wantJSON: `{"loras": [42, {}]}`},
+		{name: "index out of range", target: Target{NodeID: "5", Property: "loras.2.weight"}, wantErr: `index "2" out of range at "loras"`},
+		{name: "negative index", target: Target{NodeID: "5", Property: "/loras/-1"}, wantErr: `index "-1" out of range`},
+		{name: "index not a number", target: Target{NodeID: "5", Property: "loras.first"}, wantErr: `index "first" out of range`},
+		{name: "missing final segment", target: Target{NodeID: "5", Property: "options.strenght"}, wantErr: `"options.strenght" not found`},
+		{name: "missing input", target: Target{NodeID: "5", Property: "steps"}, wantErr: `"steps" not found`},
+		{name: "missing intermediate segment", target: Target{NodeID: "5", Property: "/extra/strength"}, wantErr: `"extra" not found`},
+		{name: "path through a scalar", target: Target{NodeID: "5", Property: "seed.value"}, wantErr: `"seed" is not an object or array`},
+		{name: "empty property", target: Target{NodeID: "5", Property: ""}, wantErr: "empty property path"},
+		{name: "unknown node", target: Target{NodeID: "9", Property: "seed"}, wantErr: "node 9 not found"},
+		{name: "node without inputs", target: Target{NodeID: "6", Property: "seed"}, wantErr: "inputs for node 6 not found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var workflow map[string]interface{}
+			if err := json.Unmarshal([]byte(targetsTemplate), &workflow); err != nil {
+				t.Fatal(err)
+			}
+
+			err := tt.target.apply(workflow, 42)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("apply() = %v, want error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("apply() = %v", err)
+			}
+
+			var want map[string]interface{}
+			if err := json.Unmarshal([]byte(tt.wantJSON), &want); err != nil {
+				t.Fatal(err)
+			}
+			inputs := workflow["5"].(map[string]interface{})["inputs"]
+			if !hasValues(inputs, want, 42) {
+				t.Errorf("inputs = %v, want them to contain %s", inputs, tt.wantJSON)
+			}
+		})
+	}
+}
+
+// hasValues reports whether got has every value of want at the same place. Empty objects in want
+// match any object, so only the path to the written value needs to be spelled out.
+func hasValues(got, want interface{}, value int) bool {
+	switch w := want.(type) {
+	case map[string]interface{}:
+		g, ok := got.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		for key, wantValue := range w {
+			if !hasValues(g[key], wantValue, value) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		g, ok := got.([]interface{})
+		if !ok || len(g) != len(w) {
+			return false
+		}
+		for i := range w {
+			if !hasValues(g[i], w[i], value) {
+				return false
+			}
+		}
+		return true
+	case float64:
+		return got == value
+	default:
+		return reflect.DeepEqual(got, want)
+	}
+}
+
+func TestBuildReportsMissingTargets(t *testing.T) {
+	m := newTestManager(t, targetsTemplate, `
+node_mappings:
+  strength: {node_id: "5", property: "/options/strength", type: float}
+  weight: {node_id: "5", property: "loras.5.weight", type: float}
+  steps:
+    type: int
+    targets:
+      - {node_id: "5", property: steps}
+      - {node_id: "7", property: steps}
+`)
+
+	workflow, err := m.Build("test", map[string]interface{}{"strength": 0.8, "weight": 0.5, "steps": 20})
+	var missingErr *MissingTargetsError
+	if !errors.As(err, &missingErr) {
+		t.Fatalf("Build() = %s, %v, want a *MissingTargetsError", workflow, err)
+	}
+	var params []string
+	for _, missing := range missingErr.Targets {
+		params = append(params, missing.Param+" "+missing.Target.NodeID)
+	}
+	if want := []string{"steps 5", "steps 7", "weight 5"}; !reflect.DeepEqual(params, want) {
+		t.Errorf("missing targets = %q, want %q", params, want)
+	}
+}
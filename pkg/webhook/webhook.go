@@ -0,0 +1,197 @@
+// Package webhook signs and verifies ComfyLite webhook deliveries.
+//
+// Every delivery carries three headers:
+//
+//	X-ComfyLite-Delivery:  unique delivery ID, identical across retries of the same webhook
+//	X-ComfyLite-Timestamp: unix time in seconds at which this attempt was signed
+//	X-ComfyLite-Signature: v1=<hex HMAC-SHA256 of "<delivery id>.<timestamp>.<body>">
+//
+// Every retry is signed with a fresh timestamp but keeps its delivery ID. Receivers should reject
+// deliveries whose timestamp is too far from their own clock and remember delivery IDs they have
+// processed, which Verifier does for them.
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	HeaderDelivery  = "X-ComfyLite-Delivery"
+	HeaderTimestamp = "X-ComfyLite-Timestamp"
+	HeaderSignature = "X-ComfyLite-Signature"
+
+	signatureVersion = "v1"
+
+	// DefaultTolerance is the accepted clock difference used when no tolerance is given.
+	DefaultTolerance = 5 * time.Minute
+	// DefaultReplayWindow is how long a Verifier remembers delivery IDs when ReplayWindow is zero.
+	// It should outlast the sender's retry schedule.
+	DefaultReplayWindow = 24 * time.Hour
+)
+
+var (
+	ErrMissingHeaders   = errors.New("webhook: missing signature headers")
+	ErrInvalidSignature = errors.New("webhook: invalid signature")
+	ErrTimestampExpired = errors.New("webhook: timestamp outside of tolerance")
+	// ErrReplayed means the delivery was processed before. Receivers should still answer with a
+	// 2xx status, the sender is most likely retrying because the first response was lost.
+	ErrReplayed = errors.New("webhook: delivery already processed")
+)
+
+// Sign returns the signature header value for a delivery.
+func Sign(secret []byte, deliveryID string, timestamp time.Time, body []byte) string {
+	return signatureVersion + "=" + hex.EncodeToString(mac(secret, deliveryID, timestamp.Unix(), body))
+}
+
+// SetHeaders signs body and sets the delivery, timestamp and signature headers on h.
+func SetHeaders(h http.Header, secret []byte, deliveryID string, timestamp time.Time, body []byte) {
+	h.Set(HeaderDelivery, deliveryID)
+	h.Set(HeaderTimestamp, strconv.FormatInt(timestamp.Unix(), 10))
+	h.Set(HeaderSignature, Sign(secret, deliveryID, timestamp, body))
+}
+
+func mac(secret []byte, deliveryID string, timestamp int64, body []byte) []byte {
+	m := hmac.New(sha256.New, secret)
+	fmt.Fprintf(m, "%s.%d.", deliveryID, timestamp)
+	m.Write(body)
+	return m.Sum(nil)
+}
+
+// Verify checks the signature and timestamp of a delivery. It does not detect replays within the
+// tolerance window, use a Verifier for that.
+func Verify(secret []byte, h http.Header, body []byte, tolerance time.Duration) error {
+	deliveryID := h.Get(HeaderDelivery)
+	timestampHeader := h.Get(HeaderTimestamp)
+	signatureHeader := h.Get(HeaderSignature)
+	if deliveryID == "" || timestampHeader == "" || signatureHeader == "" {
+		return ErrMissingHeaders
+	}
+
+	timestamp, err := strconv.ParseInt(timestampHeader, 10, 64)
+	if err != nil {
+		return ErrMissingHeaders
+	}
+	if tolerance <= 0 {
+		tolerance = DefaultTolerance
+	}
+	if age := time.Since(time.Unix(timestamp, 0)); age > tolerance || age < -tolerance {
+		return ErrTimestampExpired
+	}
+
+	expected := mac(secret, deliveryID, timestamp, body)
+	// Several signatures may be sent while a secret is being rotated
+	for _, sig := range strings.Split(signatureHeader, ",") {
+		version, value, ok := strings.Cut(strings.TrimSpace(sig), "=")
+		if !ok || version != signatureVersion {
+			continue
+		}
+		decoded, err := hex.DecodeString(value)
+		if err == nil && hmac.Equal(decoded, expected) {
+			return nil
+		}
+	}
+	return ErrInvalidSignature
+}
+
+// Verifier verifies deliveries and rejects ones it has already accepted within the replay window.
+// It is safe for concurrent use.
+type Verifier struct {
+	Secret       []byte
+	Tolerance    time.Duration
+	ReplayWindow time.Duration
+
+	mux    sync.Mutex
+	seen   map[string]time.Time
+	pruned time.Time
+}
+
+// pruneInterval is how often expired delivery IDs are dropped, so remembering an ID does not scan
+// every ID seen within the replay window.
+const pruneInterval = time.Minute
+
+func NewVerifier(secret []byte, tolerance time.Duration) *Verifier {
+	return &Verifier{Secret: secret, Tolerance: tolerance}
+}
+
+// Verify checks the delivery like the package level Verify and then records its delivery ID,
+// returning ErrReplayed if the ID was seen before. Looking up and recording the ID happen
+// atomically, so of several concurrent copies of a delivery only one is accepted. Use Check and
+// Remember separately to only record deliveries that were processed successfully, so retries
+// after a receiver error go through; concurrent copies may then both pass Check.
+func (v *Verifier) Verify(h http.Header, body []byte) error {
+	if err := Verify(v.Secret, h, body, v.Tolerance); err != nil {
+		return err
+	}
+
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	now := time.Now()
+	if v.seenLocked(h.Get(HeaderDelivery), now) {
+		return ErrReplayed
+	}
+	v.rememberLocked(h.Get(HeaderDelivery), now)
+	return nil
+}
+
+// Check verifies the signature and timestamp and that the delivery ID has not been remembered.
+func (v *Verifier) Check(h http.Header, body []byte) error {
+	if err := Verify(v.Secret, h, body, v.Tolerance); err != nil {
+		return err
+	}
+
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	if v.seenLocked(h.Get(HeaderDelivery), time.Now()) {
+		return ErrReplayed
+	}
+	return nil
+}
+
+// Remember marks a delivery ID as processed.
+func (v *Verifier) Remember(deliveryID string) {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	v.rememberLocked(deliveryID, time.Now())
+}
+
+func (v *Verifier) window() time.Duration {
+	if v.ReplayWindow <= 0 {
+		return DefaultReplayWindow
+	}
+	return v.ReplayWindow
+}
+
+// seenLocked reports whether the delivery ID was remembered within the replay window. IDs are
+// pruned lazily, so expired ones may still be in the map. Must be called with mux held.
+func (v *Verifier) seenLocked(deliveryID string, now time.Time) bool {
+	at, ok := v.seen[deliveryID]
+	return ok && now.Sub(at) <= v.window()
+}
+
+// rememberLocked records the delivery ID and drops expired IDs at most once per pruneInterval.
+// Must be called with mux held.
+func (v *Verifier) rememberLocked(deliveryID string, now time.Time) {
+	if v.seen == nil {
+		v.seen = make(map[string]time.Time)
+	}
+
+	if now.Sub(v.pruned) >= pruneInterval {
+		window := v.window()
+		for id, at := range v.seen {
+			if now.Sub(at) > window {
+				delete(v.seen, id)
+			}
+		}
+		v.pruned = now
+	}
+	v.seen[deliveryID] = now
+}
@@ -0,0 +1,240 @@
+package webhook
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testSecret = []byte("whsec_test")
+
+func signedHeaders(deliveryID string, timestamp time.Time, body []byte) http.Header {
+	h := http.Header{}
+	SetHeaders(h, testSecret, deliveryID, timestamp, body)
+	return h
+}
+
+func TestSignVerifyRoundTrip(t *testing.T) {
+	body := []byte(`{"prompt_id":"abc","status":"completed"}`)
+	h := signedHeaders("delivery-1", time.Now(), body)
+
+	if err := Verify(testSecret, h, body, 0); err != nil {
+		t.Fatalf("Verify() = %v, want nil", err)
+	}
+
+	tests := []struct {
+		name    string
+		secret  []byte
+		header  func() http.Header
+		body    []byte
+		wantErr error
+	}{
+		{
+			name:    "tampered body",
+			secret:  testSecret,
+			header:  func() http.Header { return h.Clone() },
+			body:    []byte(`{"prompt_id":"abc","status":"failed"}`),
+			wantErr: ErrInvalidSignature,
+		},
+		{
+			name:    "wrong secret",
+			secret:  []byte("other"),
+			header:  func() http.Header { return h.Clone() },
+			body:    body,
+			wantErr: ErrInvalidSignature,
+		},
+		{
+			name:   "changed delivery ID",
+			secret: testSecret,
+			header: func() http.Header {
+				c := h.Clone()
+				c.Set(HeaderDelivery, "delivery-2")
+				return c
+			},
+			body:    body,
+			wantErr: ErrInvalidSignature,
+		},
+		{
+			name:   "missing signature",
+			secret: testSecret,
+			header: func() http.Header {
+				c := h.Clone()
+				c.Del(HeaderSignature)
+				return c
+			},
+			body:    body,
+			wantErr: ErrMissingHeaders,
+		},
+		{
+			name:   "rotated secret",
+			secret: testSecret,
+			header: func() http.Header {
+				c := h.Clone()
+				c.Set(HeaderSignature, Sign([]byte("old"), "delivery-1", time.Now(), body)+","+h.Get(HeaderSignature))
+				return c
+			},
+			body: body,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Verify(tt.secret, tt.header(), tt.body, 0)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Verify() = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyTolerance(t *testing.T) {
+	body := []byte(`{}`)
+	tests := []struct {
+		name      string
+		offset    time.Duration
+		tolerance time.Duration
+		wantErr   error
+	}{
+		{name: "within default", offset: -4 * time.Minute},
+		{name: "past default", offset: -6 * time.Minute, wantErr: ErrTimestampExpired},
+		{name: "future past default", offset: 6 * time.Minute, wantErr: ErrTimestampExpired},
+		{name: "within custom", offset: -9 * time.Minute, tolerance: 10 * time.Minute},
+		{name: "past custom", offset: -30 * time.Second, tolerance: 10 * time.Second, wantErr: ErrTimestampExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := signedHeaders("delivery-1", time.Now().Add(tt.offset), body)
+			err := Verify(testSecret, h, body, tt.tolerance)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Verify() = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	t.Run("unparsable timestamp", func(t *testing.T) {
+		h := signedHeaders("delivery-1", time.Now(), body)
+		h.Set(HeaderTimestamp, "yesterday")
+		if err := Verify(testSecret, h, body, 0); !errors.Is(err, ErrMissingHeaders) {
+			t.Errorf("Verify() = %v, want %v", err, ErrMissingHeaders)
+		}
+	})
+}
+
+func TestVerifierReplay(t *testing.T) {
+	body := []byte(`{}`)
+	v := NewVerifier(testSecret, 0)
+
+	if err := v.Verify(signedHeaders("delivery-1", time.Now(), body), body); err != nil {
+		t.Fatalf("first Verify() = %v, want nil", err)
+	}
+	// A retry is signed again with a fresh timestamp but keeps its delivery ID
+	retry := signedHeaders("delivery-1", time.Now().Add(time.Second), body)
+	if err := v.Verify(retry, body); !errors.Is(err, ErrReplayed) {
+		t.Errorf("retried Verify() = %v, want %v", err, ErrReplayed)
+	}
+	if err := v.Verify(signedHeaders("delivery-2", time.Now(), body), body); err != nil {
+		t.Errorf("Verify() of another delivery = %v, want nil", err)
+	}
+}
+
+func TestVerifierCheckRemember(t *testing.T) {
+	body := []byte(`{}`)
+	v := NewVerifier(testSecret, 0)
+	h := signedHeaders("delivery-1", time.Now(), body)
+
+	// A delivery that failed to process is not remembered and can be retried
+	for i := 0; i < 2; i++ {
+		if err := v.Check(h, body); err != nil {
+			t.Fatalf("Check() #%d = %v, want nil", i+1, err)
+		}
+	}
+	v.Remember("delivery-1")
+	if err := v.Check(h, body); !errors.Is(err, ErrReplayed) {
+		t.Errorf("Check() after Remember = %v, want %v", err, ErrReplayed)
+	}
+}
+
+func TestVerifierConcurrentReplay(t *testing.T) {
+	body := []byte(`{}`)
+	v := NewVerifier(testSecret, 0)
+	h := signedHeaders("delivery-1", time.Now(), body)
+
+	const copies = 50
+	var wg sync.WaitGroup
+	var mux sync.Mutex
+	accepted := 0
+	for i := 0; i < copies; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := v.Verify(h.Clone(), body)
+			if err == nil {
+				mux.Lock()
+				accepted++
+				mux.Unlock()
+			} else if !errors.Is(err, ErrReplayed) {
+				t.Errorf("Verify() = %v, want nil or %v", err, ErrReplayed)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if accepted != 1 {
+		t.Errorf("%d of %d concurrent copies were accepted, want 1", accepted, copies)
+	}
+}
+
+func TestVerifierReplayWindow(t *testing.T) {
+	now := time.Now()
+	v := &Verifier{
+		Secret:       testSecret,
+		ReplayWindow: time.Hour,
+		seen:         map[string]time.Time{"old": now.Add(-2 * time.Hour), "recent": now.Add(-time.Minute)},
+		pruned:       now,
+	}
+
+	// Expired IDs that were not pruned yet no longer count as seen
+	v.mux.Lock()
+	expired, recent := v.seenLocked("old", now), v.seenLocked("recent", now)
+	v.mux.Unlock()
+	if expired || !recent {
+		t.Errorf("seen old=%v recent=%v, want old=false recent=true", expired, recent)
+	}
+
+	v.Remember("new")
+	v.mux.Lock()
+	_, kept := v.seen["old"]
+	v.mux.Unlock()
+	if !kept {
+		t.Errorf("delivery IDs were pruned again within pruneInterval")
+	}
+
+	// Expired IDs are dropped the next time a delivery is remembered after pruneInterval
+	v.pruned = now.Add(-pruneInterval)
+	v.Remember("newer")
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	if _, ok := v.seen["old"]; ok {
+		t.Errorf("expired delivery ID was not pruned")
+	}
+	if n := len(v.seen); n != 3 {
+		t.Errorf("len(seen) = %d, want 3", n)
+	}
+}
+
+func TestSetHeaders(t *testing.T) {
+	timestamp := time.Unix(1749560400, 0)
+	h := signedHeaders("delivery-1", timestamp, []byte(`{}`))
+
+	if got := h.Get(HeaderDelivery); got != "delivery-1" {
+		t.Errorf("%s = %q, want %q", HeaderDelivery, got, "delivery-1")
+	}
+	if got := h.Get(HeaderTimestamp); got != strconv.FormatInt(timestamp.Unix(), 10) {
+		t.Errorf("%s = %q, want %q", HeaderTimestamp, got, "1749560400")
+	}
+	if got, want := h.Get(HeaderSignature), Sign(testSecret, "delivery-1", timestamp, []byte(`{}`)); got != want {
+		t.Errorf("%s = %q, want %q", HeaderSignature, got, want)
+	}
+}